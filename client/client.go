@@ -0,0 +1,445 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package client 实现relay协议的客户端：reflex -> 创建/加入room，
+// 之后通过Conn收发经relay中转的数据。
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"relay/internal/common"
+	"relay/internal/msg"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultTimeout = time.Second
+	defaultRetries = 3
+)
+
+var (
+	ErrTimeout   = errors.New("relay: request timed out")
+	ErrIntegrity = errors.New("relay: response integrity check failed")
+	ErrInvalid   = errors.New("relay: invalid username or response")
+	// ErrRoomClosed 对端已经离开room，Read不会再收到数据
+	ErrRoomClosed = errors.New("relay: room closed by peer")
+)
+
+// Error.Code的取值，与relay回复中的错误码一致
+const (
+	CodeAuthFailed     = msg.Err_AuthFailed
+	CodeAddressInvalid = msg.Err_AddressInvalid
+	CodeTimeInvalid    = msg.Err_TimeInvalid
+	CodeRoomInvalid    = msg.Err_RoomInvalid
+	CodeUnavailable    = msg.Err_Unavailable // relay正在关闭，可以换一个实例重试
+)
+
+// Error relay在回复中返回的错误码，可以用errors.As取出后与Code*比较
+type Error struct {
+	Code int32
+}
+
+func (e *Error) Error() string {
+	switch e.Code {
+	case CodeAuthFailed:
+		return "relay: auth failed"
+	case CodeAddressInvalid:
+		return "relay: address invalid"
+	case CodeTimeInvalid:
+		return "relay: time invalid"
+	case CodeRoomInvalid:
+		return "relay: room invalid"
+	case CodeUnavailable:
+		return "relay: server unavailable"
+	default:
+		return fmt.Sprintf("relay: error code %d", e.Code)
+	}
+}
+
+type Options struct {
+	Username string
+	Password string
+	Timeout  time.Duration // 每次请求等待回复的时间，默认1秒
+	Retries  int           // 超时后重传的次数，默认3次
+}
+
+// Conn 经relay中转的数据通道，实现了net.PacketConn。
+// 对端固定是relay服务器，WriteTo会忽略addr参数
+type Conn struct {
+	socket     *net.UDPConn
+	relay      *net.UDPAddr
+	room       uuid.UUID
+	publicAddr *net.UDPAddr
+	opts       Options
+	token      string       // relay分配的session token，Rebind时使用
+	rtt        atomic.Int64 // time.Duration，最近一次Keepalive测得的往返时间
+}
+
+var _ net.PacketConn = (*Conn)(nil)
+
+// CreateRoom 向relay申请一个room，把返回的Conn.Room()交给对端加入
+func CreateRoom(relayAddr string, opts Options) (*Conn, error) {
+	c, err := dial(relayAddr, opts)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.reflex()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	request := msg.CreateRoomRequest{
+		Version:  msg.VersionThree,
+		ID:       newRequestID(),
+		Username: opts.Username,
+		Time:     time.Now(),
+		IP:       c.publicAddr.IP,
+		Port:     uint32(c.publicAddr.Port),
+		Token:    token,
+	}
+	data := request.ToBytes()
+	if data == nil {
+		c.Close()
+		return nil, ErrInvalid
+	}
+	msg.Sign(data, opts.Password)
+	response, err := c.roundTrip(data, func(resp []byte) bool {
+		r := msg.ParseCreateRoomResponse(resp)
+		return msg.IsCreateRoomResponse(resp) && r != nil && r.ID == request.ID
+	})
+	if err == nil {
+		err = c.checkResponse(response, msg.ParseCreateRoomResponse(response).ErrCode)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	r := msg.ParseCreateRoomResponse(response)
+	c.room, c.token = r.Room, r.Token
+	return c, nil
+}
+
+// newRequestID relay按ID+Integrity防重放，ID必须不可预测。
+// ID字段是16字节，用8字节随机数的hex形式正好填满
+func newRequestID() string {
+	buffer := make([]byte, common.Fixed16/2)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// JoinRoom 加入对端创建的room
+func JoinRoom(relayAddr string, room uuid.UUID, opts Options) (*Conn, error) {
+	c, err := dial(relayAddr, opts)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.reflex()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	request := msg.JoinRoomRequest{
+		Version:  msg.VersionThree,
+		ID:       newRequestID(),
+		Username: opts.Username,
+		Time:     time.Now(),
+		IP:       c.publicAddr.IP,
+		Port:     uint32(c.publicAddr.Port),
+		Token:    token,
+		Room:     room,
+	}
+	data := request.ToBytes()
+	if data == nil {
+		c.Close()
+		return nil, ErrInvalid
+	}
+	msg.Sign(data, opts.Password)
+	response, err := c.roundTrip(data, func(resp []byte) bool {
+		r := msg.ParseJoinRoomResponse(resp)
+		return msg.IsJoinRoomResponse(resp) && r != nil && r.ID == request.ID
+	})
+	if err == nil {
+		err = c.checkResponse(response, msg.ParseJoinRoomResponse(response).ErrCode)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.room = room
+	c.token = msg.ParseJoinRoomResponse(response).Token
+	return c, nil
+}
+
+func dial(relayAddr string, opts Options) (*Conn, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = defaultRetries
+	}
+	raddr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		socket: socket,
+		relay:  raddr,
+		opts:   opts,
+	}, nil
+}
+
+// reflex 获取自己的公网地址和创建/加入room所需的token
+func (c *Conn) reflex() (string, error) {
+	request := msg.ReflexRequest{Version: msg.VersionThree}
+	data, err := c.roundTrip(request.ToBytes(), msg.IsReflexResponse)
+	if err != nil {
+		return "", err
+	}
+	response := msg.ParseReflexResponse(data)
+	c.publicAddr = response.Addr
+	return response.Token, nil
+}
+
+// checkResponse 出错的回复不一定带签名，直接返回错误码；成功的回复必须通过校验
+func (c *Conn) checkResponse(data []byte, errCode int32) error {
+	if errCode != msg.Err_OK {
+		return &Error{Code: errCode}
+	}
+	if !msg.Verify(data, c.opts.Password) {
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// roundTrip 发送请求并等待match返回true的回复，超时后原样重传
+func (c *Conn) roundTrip(request []byte, match func([]byte) bool) ([]byte, error) {
+	defer c.socket.SetReadDeadline(time.Time{})
+	buffer := make([]byte, 65536)
+	for i := 0; i <= c.opts.Retries; i++ {
+		if _, err := c.socket.Write(request); err != nil {
+			return nil, err
+		}
+		c.socket.SetReadDeadline(time.Now().Add(c.opts.Timeout))
+		for {
+			n, err := c.socket.Read(buffer)
+			if err != nil {
+				if os.IsTimeout(err) {
+					break
+				}
+				return nil, err
+			}
+			if match(buffer[:n]) {
+				return append([]byte(nil), buffer[:n]...), nil
+			}
+		}
+	}
+	return nil, ErrTimeout
+}
+
+func (c *Conn) Room() uuid.UUID {
+	return c.room
+}
+
+// PublicAddr relay看到的本端地址
+func (c *Conn) PublicAddr() *net.UDPAddr {
+	return c.publicAddr
+}
+
+// Read 读取对端经relay转发过来的数据，relay的控制消息会被跳过，
+// 其中relay的keepalive探测会被自动回复。对端离开room后返回ErrRoomClosed
+func (c *Conn) Read(p []byte) (int, error) {
+	buffer := p
+	if len(buffer) < msg.BaseMessageSize {
+		// 控制消息被截断后无法识别，会被当成数据返回
+		buffer = make([]byte, msg.BaseMessageSize)
+	}
+	for {
+		n, err := c.socket.Read(buffer)
+		if err != nil {
+			return 0, err
+		}
+		switch msg.MessageType(buffer[:n]) {
+		case msg.TypeUnknown:
+			return copy(p, buffer[:n]), nil
+		case msg.TypeLeaveRoomResponse:
+			if c.isLeaveNotify(buffer[:n]) {
+				return 0, ErrRoomClosed
+			}
+		case msg.TypeKeepaliveRequest:
+			c.answerKeepalive(buffer[:n])
+		case msg.TypeKeepaliveResponse:
+			if response := msg.ParseKeepaliveResponse(buffer[:n]); response != nil && response.Room == c.room {
+				c.rtt.Store(int64(time.Since(response.Time)))
+			}
+		}
+	}
+}
+
+// isLeaveNotify relay的通知带有签名，防止他人伪造通知关闭连接
+func (c *Conn) isLeaveNotify(data []byte) bool {
+	notify := msg.ParseLeaveRoomResponse(data)
+	return notify != nil && notify.ID == msg.LeaveNotifyID && notify.Room == c.room &&
+		msg.Verify(data, c.opts.Password)
+}
+
+// answerKeepalive 原样带回relay填写的ID，relay据此找到发送时间计算RTT
+func (c *Conn) answerKeepalive(data []byte) {
+	request := msg.ParseKeepaliveRequest(data)
+	if request == nil || request.Room != c.room {
+		return
+	}
+	response := msg.NewKeepaliveResponse(msg.VersionThree, request.ID, c.room, request.Time)
+	c.socket.Write(response.ToBytes())
+}
+
+// Keepalive 暂停发送数据时定期调用，保持NAT映射和room不会空闲超时。
+// 回复在Read中处理，之后可以通过RTT获取往返时间
+func (c *Conn) Keepalive() error {
+	request := msg.NewKeepaliveRequest(msg.VersionThree, "", c.room, time.Now())
+	_, err := c.socket.Write(request.ToBytes())
+	return err
+}
+
+// RTT 最近一次Keepalive测得的到relay的往返时间，还没有测量到时返回0
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// Leave 通知relay关闭room，对端会收到ErrRoomClosed。之后仍需调用Close。
+// 离开前会重新reflex获取token，期间收到的数据会被丢弃
+func (c *Conn) Leave() error {
+	token, err := c.reflex()
+	if err != nil {
+		return err
+	}
+	request := msg.LeaveRoomRequest{
+		Version:  msg.VersionThree,
+		ID:       newRequestID(),
+		Username: c.opts.Username,
+		Time:     time.Now(),
+		IP:       c.publicAddr.IP,
+		Port:     uint32(c.publicAddr.Port),
+		Token:    token,
+		Room:     c.room,
+	}
+	data := request.ToBytes()
+	if data == nil {
+		return ErrInvalid
+	}
+	msg.Sign(data, c.opts.Password)
+	response, err := c.roundTrip(data, func(resp []byte) bool {
+		r := msg.ParseLeaveRoomResponse(resp)
+		return msg.IsLeaveRoomResponse(resp) && r != nil && r.ID == request.ID
+	})
+	if err != nil {
+		return err
+	}
+	return c.checkResponse(response, msg.ParseLeaveRoomResponse(response).ErrCode)
+}
+
+// Rebind NAT映射变化后(比如Keepalive长时间测不到RTT)调用，让relay把room中本端的地址
+// 换成新的公网地址。期间收到的数据会被丢弃
+func (c *Conn) Rebind() error {
+	// 只需要reflex得到的新地址，验证使用session token
+	if _, err := c.reflex(); err != nil {
+		return err
+	}
+	request := msg.RebindRequest{
+		Version:  msg.VersionThree,
+		ID:       newRequestID(),
+		Username: c.opts.Username,
+		Time:     time.Now(),
+		IP:       c.publicAddr.IP,
+		Port:     uint32(c.publicAddr.Port),
+		Token:    c.token,
+		Room:     c.room,
+	}
+	data := request.ToBytes()
+	if data == nil {
+		return ErrInvalid
+	}
+	msg.Sign(data, c.opts.Password)
+	response, err := c.roundTrip(data, func(resp []byte) bool {
+		r := msg.ParseRebindResponse(resp)
+		return msg.IsRebindResponse(resp) && r != nil && r.ID == request.ID
+	})
+	if err != nil {
+		return err
+	}
+	return c.checkResponse(response, msg.ParseRebindResponse(response).ErrCode)
+}
+
+// Write 把数据经relay转发给对端
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.socket.Write(p)
+}
+
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.relay, err
+}
+
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+func (c *Conn) Close() error {
+	return c.socket.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.LocalAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.socket.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.socket.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.socket.SetWriteDeadline(t)
+}
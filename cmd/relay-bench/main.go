@@ -0,0 +1,126 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// relay-bench 压测relay的转发能力：创建若干个room，每个room由申请方持续发包，
+// 加入方统计收到的包数，最后输出发送和转发的pps
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"relay/client"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	relayAddr = flag.String("relay", "127.0.0.1:19000", "relay address")
+	username  = flag.String("user", "user1", "username")
+	password  = flag.String("password", "password1", "password")
+	rooms     = flag.Int("rooms", 4, "number of rooms")
+	size      = flag.Int("size", 1200, "payload size in bytes")
+	duration  = flag.Duration("duration", 10*time.Second, "benchmark duration")
+	rate      = flag.Int("pps", 0, "packets per second per room, 0 means as fast as possible")
+)
+
+func main() {
+	flag.Parse()
+	opts := client.Options{Username: *username, Password: *password}
+	var sent, received atomic.Uint64
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < *rooms; i++ {
+		sender, err := client.CreateRoom(*relayAddr, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "CreateRoom failed: %v\n", err)
+			os.Exit(1)
+		}
+		receiver, err := client.JoinRoom(*relayAddr, sender.Room(), opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "JoinRoom(%s) failed: %v\n", sender.Room(), err)
+			os.Exit(1)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer sender.Close()
+			payload := make([]byte, *size)
+			start := time.Now()
+			var count int
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if *rate > 0 {
+					// 每发出1ms的量检查一次，超前时等待
+					if count%max(*rate/1000, 1) == 0 {
+						expected := time.Duration(count) * time.Second / time.Duration(*rate)
+						if ahead := expected - time.Since(start); ahead > 0 {
+							time.Sleep(ahead)
+						}
+					}
+				}
+				count++
+				if _, err := sender.Write(payload); err == nil {
+					sent.Add(1)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer receiver.Close()
+			buf := make([]byte, 65536)
+			for {
+				receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				if _, err := receiver.Read(buf); err == nil {
+					received.Add(1)
+					continue
+				}
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+	seconds := duration.Seconds()
+	fmt.Printf("rooms: %d, payload: %d bytes, duration: %v\n", *rooms, *size, *duration)
+	fmt.Printf("sent:     %d packets, %.0f pps\n", sent.Load(), float64(sent.Load())/seconds)
+	fmt.Printf("received: %d packets, %.0f pps (%.1f%%)\n", received.Load(), float64(received.Load())/seconds,
+		float64(received.Load())*100/float64(max(sent.Load(), 1)))
+}
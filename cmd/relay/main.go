@@ -33,10 +33,10 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"path"
 	"relay/internal/app"
 	"relay/internal/conf"
+	"relay/internal/db"
 	"relay/internal/mgr"
 	"relay/internal/server"
 	"strings"
@@ -50,18 +50,31 @@ var relaySvr *server.Server
 var mgrSvr *mgr.Server
 
 func initFunc() {
-	relaySvr = server.New(conf.Xml.Net.ListenIP, conf.Xml.Net.ListenPort)
+	relaySvr = server.New(conf.Xml.Net.ListenIP, conf.Xml.Net.ListenPort, conf.Xml.Net.Workers, conf.Xml.Net.Batch)
 	relaySvr.Start()
+	startMgr()
+}
+
+// startMgr 加载配置时已经保证开启mgr时使用了数据库
+func startMgr() {
 	if conf.Xml.Mgr.Enable {
-		if !conf.Xml.Auth.UseDB {
-			logrus.Error("You can't enable Mgr withou database!")
-			os.Exit(-1)
-		}
-		mgrSvr = mgr.New()
+		mgrSvr = mgr.New(relaySvr.SessionManager())
 		mgrSvr.Start()
 	}
 }
 
+func stopMgr() {
+	if mgrSvr != nil {
+		mgrSvr.Stop()
+		timer := time.NewTimer(time.Millisecond * 50)
+		select {
+		case <-timer.C:
+		case <-mgrSvr.StopedChan():
+		}
+		mgrSvr = nil
+	}
+}
+
 func uninitFunc() {
 	if relaySvr != nil {
 		relaySvr.Stop()
@@ -72,14 +85,43 @@ func uninitFunc() {
 		}
 		relaySvr = nil
 	}
-	if mgrSvr != nil {
-		mgrSvr.Stop()
-		timer := time.NewTimer(time.Millisecond * 50)
-		select {
-		case <-timer.C:
-		case <-mgrSvr.StopedChan():
-		}
-		mgrSvr = nil
+	stopMgr()
+}
+
+// drainFunc 不再创建新的room，等待已有的room结束，之后由uninitFunc关闭服务
+func drainFunc() <-chan struct{} {
+	if relaySvr == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	timeout := time.Duration(conf.Xml.Net.DrainTimeout) * time.Second
+	logrus.Infof("Received SIGTERM, draining with timeout %v", timeout)
+	return relaySvr.Drain(timeout)
+}
+
+// reloadFunc 重新加载配置文件，只应用可以在运行中修改的配置，不影响已有的中继连接
+func reloadFunc() {
+	oldMgr := conf.Xml.Mgr
+	changes, err := conf.Reload()
+	if err != nil {
+		logrus.Errorf("Reload config failed, keep using the old one: %v", err)
+		return
+	}
+	if len(changes) == 0 {
+		logrus.Info("Reload config: nothing changed")
+		return
+	}
+	for _, change := range changes {
+		logrus.Infof("Reload config: %s", change)
+	}
+	logrus.SetLevel(convertLogLevel(conf.Xml.Log.Level))
+	if relaySvr != nil {
+		relaySvr.SessionManager().Reload()
+	}
+	if conf.Xml.Mgr != oldMgr {
+		stopMgr()
+		startMgr()
 	}
 }
 
@@ -153,6 +195,10 @@ func convertLogLevel(level string) logrus.Level {
 }
 
 func main() {
+	if err := conf.Init(); err != nil {
+		panic(err)
+	}
 	initLogger()
-	app.Run(initFunc, uninitFunc, dumpFunc)
+	db.Init()
+	app.Run(initFunc, uninitFunc, dumpFunc, reloadFunc, drainFunc)
 }
@@ -0,0 +1,208 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+var ErrInvalidKind = errors.New("acl kind must be allow or deny")
+
+// Rules 网段列表，CIDR格式，IPv4和IPv6可以混合
+type Rules struct {
+	Allow []string
+	Deny  []string
+}
+
+type compiled struct {
+	rules Rules
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// List 允许/拒绝网段列表。deny优先，allow为空时允许所有不在deny中的地址。
+// 每个包都要检查，所以读取不加锁，修改时复制一份再整体替换
+type List struct {
+	mutex   sync.Mutex // 串行化修改
+	current atomic.Pointer[compiled]
+}
+
+func New(rules Rules) (*List, error) {
+	l := &List{}
+	if err := l.Set(rules); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Set 整体替换列表，有任何一个网段无效时保持原列表不变
+func (l *List) Set(rules Rules) error {
+	c, err := compile(rules)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.current.Store(c)
+	return nil
+}
+
+// Rules 返回当前列表的副本
+func (l *List) Rules() Rules {
+	rules := l.current.Load().rules
+	return Rules{
+		Allow: append([]string{}, rules.Allow...),
+		Deny:  append([]string{}, rules.Deny...),
+	}
+}
+
+func (l *List) Empty() bool {
+	c := l.current.Load()
+	return len(c.allow) == 0 && len(c.deny) == 0
+}
+
+func (l *List) Allowed(ip net.IP) bool {
+	c := l.current.Load()
+	for _, ipNet := range c.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range c.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add 添加一个网段，已经存在时不重复添加
+func (l *List) Add(kind string, cidr string) error {
+	ipNet, err := parse(cidr)
+	if err != nil {
+		return err
+	}
+	return l.update(kind, func(cidrs []string) []string {
+		for _, existing := range cidrs {
+			if existing == ipNet.String() {
+				return cidrs
+			}
+		}
+		return append(cidrs, ipNet.String())
+	})
+}
+
+// Remove 删除一个网段，返回它是否存在
+func (l *List) Remove(kind string, cidr string) (bool, error) {
+	ipNet, err := parse(cidr)
+	if err != nil {
+		return false, err
+	}
+	removed := false
+	err = l.update(kind, func(cidrs []string) []string {
+		var result []string
+		for _, existing := range cidrs {
+			if existing == ipNet.String() {
+				removed = true
+				continue
+			}
+			result = append(result, existing)
+		}
+		return result
+	})
+	return removed, err
+}
+
+func (l *List) update(kind string, modify func([]string) []string) error {
+	if kind != Allow && kind != Deny {
+		return ErrInvalidKind
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	old := l.current.Load().rules
+	rules := Rules{
+		Allow: append([]string{}, old.Allow...),
+		Deny:  append([]string{}, old.Deny...),
+	}
+	if kind == Allow {
+		rules.Allow = modify(rules.Allow)
+	} else {
+		rules.Deny = modify(rules.Deny)
+	}
+	c, err := compile(rules)
+	if err != nil {
+		return err
+	}
+	l.current.Store(c)
+	return nil
+}
+
+// compile 网段统一保存为规范形式，比如192.168.1.1/24保存为192.168.1.0/24
+func compile(rules Rules) (*compiled, error) {
+	c := &compiled{}
+	for _, cidr := range rules.Allow {
+		ipNet, err := parse(cidr)
+		if err != nil {
+			return nil, err
+		}
+		c.allow = append(c.allow, ipNet)
+		c.rules.Allow = append(c.rules.Allow, ipNet.String())
+	}
+	for _, cidr := range rules.Deny {
+		ipNet, err := parse(cidr)
+		if err != nil {
+			return nil, err
+		}
+		c.deny = append(c.deny, ipNet)
+		c.rules.Deny = append(c.rules.Deny, ipNet.String())
+	}
+	return c, nil
+}
+
+func parse(cidr string) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr '%s'", cidr)
+	}
+	return ipNet, nil
+}
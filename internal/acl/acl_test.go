@@ -0,0 +1,178 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package acl
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules Rules
+		ip    string
+		want  bool
+	}{
+		{"empty list", Rules{}, "10.0.0.1", true},
+		{"empty list ipv6", Rules{}, "2001:db8::1", true},
+		{"in allow", Rules{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3", true},
+		{"not in allow", Rules{Allow: []string{"10.0.0.0/8"}}, "192.168.1.1", false},
+		{"deny only", Rules{Deny: []string{"192.168.0.0/16"}}, "192.168.1.1", false},
+		{"not in deny", Rules{Deny: []string{"192.168.0.0/16"}}, "10.0.0.1", true},
+		{"deny wins", Rules{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}}, "10.1.2.3", false},
+		{"allow outside deny", Rules{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}}, "10.2.0.1", true},
+		{"ipv6 allow", Rules{Allow: []string{"2001:db8::/32"}}, "2001:db8::1", true},
+		{"ipv6 not in allow", Rules{Allow: []string{"2001:db8::/32"}}, "2001:db9::1", false},
+		{"ipv6 deny", Rules{Deny: []string{"2001:db8::/32"}}, "2001:db8::1", false},
+		{"mixed list ipv4", Rules{Allow: []string{"2001:db8::/32", "10.0.0.0/8"}}, "10.0.0.1", true},
+		// 双栈socket收到的IPv4-mapped地址按IPv4网段匹配
+		{"ipv4-mapped allow", Rules{Allow: []string{"10.0.0.0/8"}}, "::ffff:10.0.0.1", true},
+		{"ipv4-mapped deny", Rules{Deny: []string{"10.0.0.0/8"}}, "::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		l, err := New(tt.rules)
+		if err != nil {
+			t.Fatalf("%s: New: %v", tt.name, err)
+		}
+		if got := l.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: Allowed(%s) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []Rules{
+		{Allow: []string{"10.0.0.1"}},
+		{Deny: []string{"not a cidr"}},
+		{Allow: []string{"10.0.0.0/33"}},
+	}
+	for _, rules := range tests {
+		if _, err := New(rules); err == nil {
+			t.Errorf("New(%v) succeeded, want error", rules)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	l, err := New(Rules{Allow: []string{"192.168.1.1/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Empty() {
+		t.Error("Empty = true with an allow rule")
+	}
+	// 保存规范形式
+	want := Rules{Allow: []string{"192.168.1.0/24"}}
+	if got := l.Rules(); !reflect.DeepEqual(got.Allow, want.Allow) || len(got.Deny) != 0 {
+		t.Errorf("Rules = %v, want %v", got, want)
+	}
+	// 无效列表不改变原列表
+	if err := l.Set(Rules{Deny: []string{"bad"}}); err == nil {
+		t.Error("Set with invalid cidr succeeded")
+	}
+	if got := l.Rules(); !reflect.DeepEqual(got.Allow, want.Allow) {
+		t.Errorf("Rules after failed Set = %v, want %v", got, want)
+	}
+	// 返回的是副本
+	l.Rules().Allow[0] = "10.0.0.0/8"
+	if got := l.Rules(); !reflect.DeepEqual(got.Allow, want.Allow) {
+		t.Errorf("Rules modified through returned copy: %v", got)
+	}
+	if err := l.Set(Rules{}); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Empty() {
+		t.Error("Empty = false after Set(Rules{})")
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	l, err := New(Rules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(Deny, "10.1.2.3/16"); err != nil {
+		t.Fatal(err)
+	}
+	// 同一网段的不同写法不重复添加
+	if err := l.Add(Deny, "10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(Allow, "10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	want := Rules{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}}
+	if got := l.Rules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Rules = %v, want %v", got, want)
+	}
+	if l.Allowed(net.ParseIP("10.1.0.1")) {
+		t.Error("denied address allowed")
+	}
+
+	tests := []struct {
+		name    string
+		kind    string
+		cidr    string
+		removed bool
+		err     bool
+	}{
+		{"invalid kind", "block", "10.1.0.0/16", false, true},
+		{"invalid cidr", Deny, "10.1.0.0", false, true},
+		{"other kind", Allow, "10.1.0.0/16", false, false},
+		{"non canonical", Deny, "10.1.255.255/16", true, false},
+		{"already removed", Deny, "10.1.0.0/16", false, false},
+	}
+	for _, tt := range tests {
+		removed, err := l.Remove(tt.kind, tt.cidr)
+		if (err != nil) != tt.err || removed != tt.removed {
+			t.Errorf("%s: Remove = %v, %v, want removed %v, error %v", tt.name, removed, err, tt.removed, tt.err)
+		}
+	}
+	if !l.Allowed(net.ParseIP("10.1.0.1")) {
+		t.Error("address still denied after Remove")
+	}
+
+	if err := l.Add("block", "10.0.0.0/8"); !errors.Is(err, ErrInvalidKind) {
+		t.Errorf("Add with invalid kind: %v, want ErrInvalidKind", err)
+	}
+	if err := l.Add(Allow, "bad"); err == nil {
+		t.Error("Add with invalid cidr succeeded")
+	}
+	if _, err := l.Remove(Allow, "10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Empty() {
+		t.Errorf("Empty = false, rules %v", l.Rules())
+	}
+}
@@ -31,38 +31,54 @@
 package app
 
 import (
-	"log"
 	"os"
 	"os/signal"
-	"runtime/debug"
 	"syscall"
 	"time"
 )
 
 // Run 执行一个非阻塞函数，然后自己进入永久性的wait中，
-// 直到捕获到SIGTERM、SIGINT
-func Run(initFunc func(), uninitFunc func(), dumpFunc func()) {
+// 直到捕获到SIGTERM、SIGINT。捕获到SIGHUP时调用reloadFunc。
+// 捕获到SIGTERM时先调用drainFunc，等它返回的chan关闭后再退出，期间再次收到SIGTERM或SIGINT则立即退出
+func Run(initFunc func(), uninitFunc func(), dumpFunc func(), reloadFunc func(), drainFunc func() <-chan struct{}) {
 	if initFunc != nil {
 		initFunc()
 	}
 	sigint := make(chan os.Signal, 2)
 	sigterm := make(chan os.Signal, 2)
+	sighup := make(chan os.Signal, 2)
 	signal.Notify(sigint, syscall.SIGINT)
 	signal.Notify(sigterm, syscall.SIGTERM)
+	signal.Notify(sighup, syscall.SIGHUP)
 	tick := time.NewTicker(time.Second)
+	var drained <-chan struct{}
 	for {
 		select {
 		case <-tick.C:
 			if dumpFunc != nil {
 				dumpFunc()
 			}
+		case <-sighup:
+			if reloadFunc != nil {
+				reloadFunc()
+			}
 		case <-sigint:
 			if uninitFunc != nil {
 				uninitFunc()
 				return
 			}
 		case <-sigterm:
-			log.Println(string(debug.Stack()))
+			if drainFunc == nil || drained != nil {
+				if uninitFunc != nil {
+					uninitFunc()
+				}
+				return
+			}
+			drained = drainFunc()
+		case <-drained:
+			if uninitFunc != nil {
+				uninitFunc()
+			}
 			return
 		}
 	}
@@ -1,12 +1,196 @@
 package auth
 
 import (
+	"crypto/hmac"
 	"net"
+	"relay/internal/conf"
 	"relay/internal/msg"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
 type Authenticator interface {
-	Stop()
-	Auth(addr *net.UDPAddr, request *msg.CreateRoomRequest, data []byte) int32
-	Token() string
+	Auth(addr *net.UDPAddr, request *msg.CreateRoomRequest, data []byte) Result
+	AuthJoin(addr *net.UDPAddr, request *msg.JoinRoomRequest, data []byte) Result
+	AuthLeave(addr *net.UDPAddr, request *msg.LeaveRoomRequest, data []byte) Result
+	// AuthRebind request.Token是session token，由SessionManager校验
+	AuthRebind(addr *net.UDPAddr, request *msg.RebindRequest, data []byte) Result
+	// Token 返回ReflexResponse中发给addr的token，由TokenProvider实现
+	Token(addr *net.UDPAddr) string
+	Limit(username string) Limit
+	// Key 返回用户计算hmac所用的密钥
+	Key(username string) (string, bool)
+	// Reload 配置文件重新加载后调用
+	Reload()
+}
+
+// Result 验证结果
+type Result struct {
+	ErrCode int32
+	// Key 验证通过时用户的密钥，给回复签名时直接使用，不需要再查询一次
+	Key string
+	// CountUser 失败是否计入用户名的封禁统计。token、地址和时间都正确而hmac错误时才为true，
+	// 之前的检查不需要知道密钥，任何人都能用别人的用户名制造这些失败，只能计入来源IP
+	CountUser bool
+}
+
+// Limit 用户级别的限速，单位kbps，0表示使用全局配置
+type Limit struct {
+	ReqToResp uint32
+	RespToReq uint32
+}
+
+// authRequest 各类请求中参与验证的字段
+type authRequest struct {
+	kind      string // create_room、join_room、leave_room或rebind
+	username  string
+	time      time.Time
+	token     string
+	ip        net.IP
+	port      uint32
+	room      uuid.UUID
+	integrity string
+	// rebind的Token是session token，由SessionManager校验；
+	// VersionTwo的客户端加入room时不一定携带token和地址
+	checkToken   bool
+	checkAddress bool
+}
+
+// keyLookup 返回验证请求所用的密钥，用户不存在或不允许这次请求时返回false
+type keyLookup func(addr *net.UDPAddr, request *authRequest) (string, bool)
+
+// keyByUsername 只按用户名查询密钥的验证方式使用
+func keyByUsername(key func(username string) (string, bool)) keyLookup {
+	return func(addr *net.UDPAddr, request *authRequest) (string, bool) {
+		return key(request.username)
+	}
+}
+
+// verifier 实现Authenticator中与验证方式无关的部分：依次校验reflex token、地址、时间和hmac。
+// 验证方式嵌入verifier，只需要提供查询密钥的方法以及Limit、Key，Reload中需要调用verifier.Reload
+type verifier struct {
+	*TokenProvider
+	lookup      keyLookup
+	maxTimeSkew atomic.Int64 // time.Duration
+}
+
+func newVerifier(lookup keyLookup) *verifier {
+	v := &verifier{
+		TokenProvider: NewTokenProvider(),
+		lookup:        lookup,
+	}
+	v.maxTimeSkew.Store(int64(time.Duration(conf.Xml.Auth.MaxTimeSkew) * time.Second))
+	return v
+}
+
+// Reload 重新加载token和max_time_skew配置
+func (v *verifier) Reload() {
+	v.TokenProvider.Reload()
+	v.maxTimeSkew.Store(int64(time.Duration(conf.Xml.Auth.MaxTimeSkew) * time.Second))
+}
+
+// checkTime 请求时间与服务器时间相差超过max_time_skew时拒绝，0表示不检查
+func (v *verifier) checkTime(t time.Time) bool {
+	maxTimeSkew := time.Duration(v.maxTimeSkew.Load())
+	if maxTimeSkew <= 0 {
+		return true
+	}
+	diff := time.Since(t)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= maxTimeSkew
+}
+
+func (v *verifier) verify(addr *net.UDPAddr, request *authRequest, data []byte) Result {
+	if request.checkToken && !v.checkToken(addr, request.username, request.token) {
+		return Result{ErrCode: msg.Err_AuthFailed}
+	}
+	// 如果不校验IP:Port，其他人捕获到合法的请求包，发出一模一样的内容，也能使用relay服务器的资源
+	if request.checkAddress && !checkAddress(addr, request.ip, request.port) {
+		logrus.Warnf("Packet(user:%s) address invalid", request.username)
+		return Result{ErrCode: msg.Err_AddressInvalid}
+	}
+	if !v.checkTime(request.time) {
+		logrus.Warnf("Packet(user:%s) time(%v) invalid", request.username, request.time)
+		return Result{ErrCode: msg.Err_TimeInvalid}
+	}
+	key, exists := v.lookup(addr, request)
+	if !exists || !checkIntegrity(key, data, request.integrity) {
+		return Result{ErrCode: msg.Err_AuthFailed, CountUser: true}
+	}
+	return Result{ErrCode: msg.Err_OK, Key: key}
+}
+
+func (v *verifier) Auth(addr *net.UDPAddr, request *msg.CreateRoomRequest, data []byte) Result {
+	return v.verify(addr, &authRequest{
+		kind:         "create_room",
+		username:     request.Username,
+		time:         request.Time,
+		token:        request.Token,
+		ip:           request.IP,
+		port:         request.Port,
+		integrity:    request.Integrity,
+		checkToken:   true,
+		checkAddress: true,
+	}, data)
+}
+
+func (v *verifier) AuthJoin(addr *net.UDPAddr, request *msg.JoinRoomRequest, data []byte) Result {
+	return v.verify(addr, &authRequest{
+		kind:         "join_room",
+		username:     request.Username,
+		time:         request.Time,
+		token:        request.Token,
+		ip:           request.IP,
+		port:         request.Port,
+		room:         request.Room,
+		integrity:    request.Integrity,
+		checkToken:   request.Version != msg.VersionTwo,
+		checkAddress: request.Version != msg.VersionTwo,
+	}, data)
+}
+
+func (v *verifier) AuthLeave(addr *net.UDPAddr, request *msg.LeaveRoomRequest, data []byte) Result {
+	return v.verify(addr, &authRequest{
+		kind:         "leave_room",
+		username:     request.Username,
+		time:         request.Time,
+		token:        request.Token,
+		ip:           request.IP,
+		port:         request.Port,
+		room:         request.Room,
+		integrity:    request.Integrity,
+		checkToken:   true,
+		checkAddress: true,
+	}, data)
+}
+
+func (v *verifier) AuthRebind(addr *net.UDPAddr, request *msg.RebindRequest, data []byte) Result {
+	return v.verify(addr, &authRequest{
+		kind:         "rebind",
+		username:     request.Username,
+		time:         request.Time,
+		ip:           request.IP,
+		port:         request.Port,
+		room:         request.Room,
+		integrity:    request.Integrity,
+		checkAddress: true,
+	}, data)
+}
+
+// checkAddress 校验请求中携带的地址与收包地址是否一致，IPv4与IPv6均适用。
+// 双栈socket收到的IPv4地址是16字节的IPv4-mapped形式，不能直接比较字节
+func checkAddress(addr *net.UDPAddr, ip net.IP, port uint32) bool {
+	return ip.Equal(addr.IP) && port == uint32(addr.Port)
+}
+
+// checkIntegrity 校验以key为密钥的hmac，data为消息中Integrity之前的部分
+func checkIntegrity(key string, data []byte, integrity string) bool {
+	sum := msg.Integrity(data, key)
+	logrus.Debug("Integrity:", integrity, ", Sum:", string(sum))
+	return hmac.Equal([]byte(integrity), sum)
 }
@@ -0,0 +1,126 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"relay/internal/msg"
+)
+
+var testAddr = &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+// signed 用key签名后返回完整的消息
+func signed(data []byte, key string) []byte {
+	msg.Sign(data, key)
+	return data
+}
+
+func TestVerifier(t *testing.T) {
+	a := NewXmlAuthenticator()
+	if a == nil {
+		t.Fatal("NewXmlAuthenticator failed with the default config")
+	}
+	token := a.Token(testAddr)
+	room := uuid.New()
+	create := func(username, password, token string, ip string, port uint32) int32 {
+		data := signed((&msg.CreateRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: username,
+			Time: time.Now(), IP: net.ParseIP(ip), Port: port, Token: token}).ToBytes(), password)
+		return a.Auth(testAddr, msg.ParseCreateRoomRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize]).ErrCode
+	}
+	join := func(version uint32, token string, ip string) int32 {
+		data := signed((&msg.JoinRoomRequest{Version: version, ID: "0123456789abcdef", Username: "user2",
+			Time: time.Now(), IP: net.ParseIP(ip), Port: 40000, Token: token, Room: room}).ToBytes(), "password2")
+		return a.AuthJoin(testAddr, msg.ParseJoinRoomRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize]).ErrCode
+	}
+	rebind := func(ip string, port uint32) int32 {
+		data := signed((&msg.RebindRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: "user1",
+			Time: time.Now(), IP: net.ParseIP(ip), Port: port, Token: "session", Room: room}).ToBytes(), "password1")
+		return a.AuthRebind(testAddr, msg.ParseRebindRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize]).ErrCode
+	}
+	tests := []struct {
+		name string
+		got  int32
+		want int32
+	}{
+		{"create ok", create("user1", "password1", token, "10.0.0.1", 40000), msg.Err_OK},
+		{"create ipv4-mapped", create("user1", "password1", token, "::ffff:10.0.0.1", 40000), msg.Err_OK},
+		{"create bad token", create("user1", "password1", "0000000000000000", "10.0.0.1", 40000), msg.Err_AuthFailed},
+		{"create bad ip", create("user1", "password1", token, "10.0.0.2", 40000), msg.Err_AddressInvalid},
+		{"create bad port", create("user1", "password1", token, "10.0.0.1", 40001), msg.Err_AddressInvalid},
+		{"create bad password", create("user1", "password2", token, "10.0.0.1", 40000), msg.Err_AuthFailed},
+		{"create unknown user", create("nobody", "password1", token, "10.0.0.1", 40000), msg.Err_AuthFailed},
+		{"join v3 ok", join(msg.VersionThree, token, "10.0.0.1"), msg.Err_OK},
+		{"join v3 without token", join(msg.VersionThree, "", "10.0.0.1"), msg.Err_AuthFailed},
+		// VersionTwo的客户端加入room时不校验token和地址
+		{"join v2 without token", join(msg.VersionTwo, "", "10.0.0.9"), msg.Err_OK},
+		// rebind的Token是session token，只校验地址和hmac
+		{"rebind ok", rebind("10.0.0.1", 40000), msg.Err_OK},
+		{"rebind bad address", rebind("10.0.0.1", 1), msg.Err_AddressInvalid},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// 时间在token和地址之后、hmac之前检查，只有hmac错误才计入用户名
+func TestVerifierStages(t *testing.T) {
+	a := NewXmlAuthenticator()
+	token := a.Token(testAddr)
+	create := func(password string, token string, at time.Time) Result {
+		data := signed((&msg.CreateRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: "user1",
+			Time: at, IP: testAddr.IP, Port: uint32(testAddr.Port), Token: token}).ToBytes(), password)
+		return a.Auth(testAddr, msg.ParseCreateRoomRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize])
+	}
+	old := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name      string
+		result    Result
+		errCode   int32
+		countUser bool
+	}{
+		{"bad token and time", create("password1", "", old), msg.Err_AuthFailed, false},
+		{"bad time and password", create("wrong", token, old), msg.Err_TimeInvalid, false},
+		{"bad password", create("wrong", token, time.Now()), msg.Err_AuthFailed, true},
+		{"ok", create("password1", token, time.Now()), msg.Err_OK, false},
+	}
+	for _, tt := range tests {
+		if tt.result.ErrCode != tt.errCode || tt.result.CountUser != tt.countUser {
+			t.Errorf("%s: got %+v, want ErrCode %d CountUser %v", tt.name, tt.result, tt.errCode, tt.countUser)
+		}
+	}
+}
@@ -31,91 +31,44 @@
 package auth
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/binary"
-	"net"
-	"relay/internal/common"
 	"relay/internal/db"
-	"relay/internal/msg"
-	"sync"
-	"time"
-
-	"github.com/sirupsen/logrus"
 )
 
+// DBAuthenticator 用户保存在db包打开的数据库(auth.db)中
 type DBAuthenticator struct {
-	lastToken     string
-	currToken     string
-	validDuration time.Duration
-	stopChan      chan struct{}
-	mutex         sync.Mutex
-}
-
-func NewDBAuthenticator(path string) Authenticator {
-	token := common.RandStr(common.Fixed16)
-	a := &DBAuthenticator{
-		lastToken:     token,
-		currToken:     token,
-		validDuration: time.Second * 5,
-	}
-	go a.changeToken()
-	return a
+	*verifier
 }
 
-func (a *DBAuthenticator) changeToken() {
-	ticker := time.NewTicker(a.validDuration)
-	for {
-		select {
-		case <-a.stopChan:
-			return
-		case <-ticker.C:
-			a.mutex.Lock()
-			a.lastToken = a.currToken
-			a.currToken = common.RandStr(common.Fixed16)
-			a.mutex.Unlock()
-		}
-	}
+func init() {
+	Register("db", NewDBAuthenticator)
 }
 
-func (a *DBAuthenticator) Stop() {
-	a.stopChan <- struct{}{}
+func NewDBAuthenticator() Authenticator {
+	a := &DBAuthenticator{}
+	a.verifier = newVerifier(keyByUsername(a.Key))
+	return a
 }
 
-func (a *DBAuthenticator) Token() string {
-	a.mutex.Lock()
-	token := a.currToken
-	a.mutex.Unlock()
-	return token
+// Reload 用户保存在数据库中，修改即时生效，只需要重新加载token和时间配置
+func (a *DBAuthenticator) Reload() {
+	a.verifier.Reload()
 }
 
-func (a *DBAuthenticator) Auth(addr *net.UDPAddr, request *msg.CreateRoomRequest, data []byte) int32 {
-	a.mutex.Lock()
-	lastToken := a.lastToken
-	currToken := a.currToken
-	a.mutex.Unlock()
-	// 校验Token
-	if lastToken != request.Token && currToken != request.Token {
-		logrus.Warnf("Packet(user:%s) token invalid", request.Username)
-		return msg.Err_AuthFailed
+func (a *DBAuthenticator) Limit(username string) Limit {
+	user, err := db.QueryByUserName(username)
+	if err != nil {
+		return Limit{}
 	}
-	// 如果不校验IP:Port，其他人捕获到合法的CreateRoomRequest包，发出一模一样的内容，也能使用relay服务器的资源
-	if request.IP != binary.LittleEndian.Uint32(addr.IP) || request.Port != uint32(addr.Port) {
-		logrus.Warnf("Packet(user:%s) address invalid", request.Username)
-		return msg.Err_AddressInvalid
+	return Limit{
+		ReqToResp: user.ReqToResp,
+		RespToReq: user.RespToReq,
 	}
-	// 校验hmac
-	user, err := db.QueryByUserName(request.Username)
+}
+
+func (a *DBAuthenticator) Key(username string) (string, bool) {
+	user, err := db.QueryByUserName(username)
 	if err != nil {
-		return msg.Err_AuthFailed
-	}
-	h := hmac.New(sha1.New, []byte(user.Password))
-	h.Write(data)
-	sum := string(h.Sum(nil))
-	logrus.Debug("Integrity:", request.Integrity, ", Sum:", sum)
-	if request.Integrity == sum {
-		return msg.Err_OK
-	} else {
-		return msg.Err_AuthFailed
+		return "", false
 	}
+	return user.Password, true
 }
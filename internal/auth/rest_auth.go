@@ -0,0 +1,127 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"relay/internal/conf"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RESTAuthenticator TURN REST API风格的临时凭证，不需要保存用户。
+// 用户名为"过期时间"或"过期时间:用户标识"，过期时间是Unix时间戳(秒)，
+// 密码为base64(HMAC-SHA1(shared_secret, 用户名))。
+// 用户名最长16字节，用户标识最多5个字符。
+// 过期的凭证不能再创建或加入room，已经建立的room可以继续离开和rebind
+type RESTAuthenticator struct {
+	*verifier
+	mutex  sync.Mutex
+	secret string
+}
+
+func init() {
+	Register("turn_rest", NewRESTAuthenticator)
+}
+
+func NewRESTAuthenticator() Authenticator {
+	a := &RESTAuthenticator{
+		secret: conf.Xml.Auth.SharedSecret,
+	}
+	a.verifier = newVerifier(a.requestKey)
+	return a
+}
+
+// Reload 更换shared_secret后，用旧secret签发的凭证立即失效
+func (a *RESTAuthenticator) Reload() {
+	a.verifier.Reload()
+	a.mutex.Lock()
+	a.secret = conf.Xml.Auth.SharedSecret
+	a.mutex.Unlock()
+}
+
+// parseExpiry 解析用户名中的过期时间
+func parseExpiry(username string) (time.Time, bool) {
+	timestamp, _, _ := strings.Cut(username, ":")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// checkExpiry 只需要解析用户名，不需要查询任何存储
+func checkExpiry(username string) bool {
+	expireAt, ok := parseExpiry(username)
+	if !ok {
+		logrus.Warnf("Packet(user:%s) username is not a valid credential", username)
+		return false
+	}
+	if !time.Now().Before(expireAt) {
+		logrus.Warnf("Packet(user:%s) credential expired at %v", username, expireAt)
+		return false
+	}
+	return true
+}
+
+// requestKey 过期的凭证不能再创建或加入room，离开和rebind不检查，避免已经建立的转发中断。
+// 用户名格式不对时Key返回false，和hmac错误一样返回Err_AuthFailed
+func (a *RESTAuthenticator) requestKey(addr *net.UDPAddr, request *authRequest) (string, bool) {
+	if (request.kind == "create_room" || request.kind == "join_room") && !checkExpiry(request.username) {
+		return "", false
+	}
+	return a.Key(request.username)
+}
+
+// Limit 临时凭证没有用户级别的配置，使用全局限速
+func (a *RESTAuthenticator) Limit(username string) Limit {
+	return Limit{}
+}
+
+// Key 不检查过期时间，回复已建立的room的请求时仍然需要签名
+func (a *RESTAuthenticator) Key(username string) (string, bool) {
+	if _, ok := parseExpiry(username); !ok {
+		return "", false
+	}
+	a.mutex.Lock()
+	secret := a.secret
+	a.mutex.Unlock()
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), true
+}
@@ -0,0 +1,88 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"relay/internal/conf"
+	"relay/internal/msg"
+)
+
+func restPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 过期的凭证不能创建room，但仍然可以离开已经建立的room
+func TestRESTExpiry(t *testing.T) {
+	old := conf.Xml.Auth.SharedSecret
+	conf.Xml.Auth.SharedSecret = "secret"
+	defer func() { conf.Xml.Auth.SharedSecret = old }()
+	a := NewRESTAuthenticator()
+	token := a.Token(testAddr)
+	room := uuid.New()
+	create := func(username string) int32 {
+		data := signed((&msg.CreateRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: username,
+			Time: time.Now(), IP: testAddr.IP, Port: uint32(testAddr.Port), Token: token}).ToBytes(), restPassword("secret", username))
+		return a.Auth(testAddr, msg.ParseCreateRoomRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize]).ErrCode
+	}
+	leave := func(username string) int32 {
+		data := signed((&msg.LeaveRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: username,
+			Time: time.Now(), IP: testAddr.IP, Port: uint32(testAddr.Port), Token: token, Room: room}).ToBytes(), restPassword("secret", username))
+		return a.AuthLeave(testAddr, msg.ParseLeaveRoomRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize]).ErrCode
+	}
+	valid := fmt.Sprintf("%d:bob", time.Now().Add(time.Hour).Unix())
+	expired := fmt.Sprintf("%d:bob", time.Now().Add(-time.Hour).Unix())
+	tests := []struct {
+		name string
+		got  int32
+		want int32
+	}{
+		{"create valid", create(valid), msg.Err_OK},
+		{"create expired", create(expired), msg.Err_AuthFailed},
+		{"create malformed", create("bob"), msg.Err_AuthFailed},
+		{"leave expired", leave(expired), msg.Err_OK},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"relay/internal/conf"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TokenProvider 生成和校验ReflexResponse中的token，所有Authenticator共用。
+// token = hex(HMAC-SHA256(secret, 时间窗口序号 + 客户端地址)[:8])，不需要保存任何状态，
+// 只要配置了相同的token_secret，一个实例签发的token可以在集群中其他实例上校验。
+// 校验时接受前后各一个窗口，容忍请求耗时和实例之间的时钟误差
+type TokenProvider struct {
+	mutex  sync.Mutex
+	secret []byte
+	window time.Duration
+	random []byte // 没有配置token_secret时使用的随机密钥
+}
+
+func NewTokenProvider() *TokenProvider {
+	p := &TokenProvider{
+		random: make([]byte, sha256.Size),
+	}
+	rand.Read(p.random)
+	p.load()
+	return p
+}
+
+func (p *TokenProvider) load() {
+	secret := []byte(conf.Xml.Auth.TokenSecret)
+	if len(secret) == 0 {
+		secret = p.random
+	}
+	window := time.Duration(conf.Xml.Auth.TokenWindow) * time.Second
+	if window <= 0 {
+		window = 5 * time.Second
+	}
+	p.mutex.Lock()
+	p.secret = secret
+	p.window = window
+	p.mutex.Unlock()
+}
+
+// Reload 更换token_secret后，之前签发的token立即失效
+func (p *TokenProvider) Reload() {
+	p.load()
+}
+
+// Token 返回addr在当前时间窗口的token
+func (p *TokenProvider) Token(addr *net.UDPAddr) string {
+	p.mutex.Lock()
+	secret, window := p.secret, p.window
+	p.mutex.Unlock()
+	return computeToken(secret, time.Now().UnixNano()/int64(window), addr)
+}
+
+// checkToken 校验token是否是签发给addr的
+func (p *TokenProvider) checkToken(addr *net.UDPAddr, username string, token string) bool {
+	p.mutex.Lock()
+	secret, window := p.secret, p.window
+	p.mutex.Unlock()
+	current := time.Now().UnixNano() / int64(window)
+	for index := current - 1; index <= current+1; index++ {
+		if hmac.Equal([]byte(token), []byte(computeToken(secret, index, addr))) {
+			return true
+		}
+	}
+	logrus.Warnf("Packet(user:%s) token invalid", username)
+	return false
+}
+
+// computeToken IPv4地址统一为16字节的形式，双栈socket收到的IPv4-mapped地址得到相同的token
+func computeToken(secret []byte, index int64, addr *net.UDPAddr) string {
+	var buffer [8 + net.IPv6len + 2]byte
+	binary.BigEndian.PutUint64(buffer[:8], uint64(index))
+	copy(buffer[8:8+net.IPv6len], addr.IP.To16())
+	binary.BigEndian.PutUint16(buffer[8+net.IPv6len:], uint16(addr.Port))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(buffer[:])
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
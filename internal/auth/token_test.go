@@ -0,0 +1,124 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"relay/internal/conf"
+)
+
+func newTestTokenProvider(t *testing.T, secret string, window int) *TokenProvider {
+	t.Helper()
+	oldSecret, oldWindow := conf.Xml.Auth.TokenSecret, conf.Xml.Auth.TokenWindow
+	conf.Xml.Auth.TokenSecret = secret
+	conf.Xml.Auth.TokenWindow = window
+	t.Cleanup(func() {
+		conf.Xml.Auth.TokenSecret, conf.Xml.Auth.TokenWindow = oldSecret, oldWindow
+	})
+	return NewTokenProvider()
+}
+
+func TestTokenWindow(t *testing.T) {
+	// 窗口取得足够长，测试过程中不会跨过窗口边界
+	p := newTestTokenProvider(t, "secret", 3600)
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	secret, window := []byte("secret"), time.Hour
+	current := time.Now().UnixNano() / int64(window)
+	tests := []struct {
+		name  string
+		index int64
+		want  bool
+	}{
+		{"current", current, true},
+		{"previous window", current - 1, true},
+		{"next window", current + 1, true},
+		{"two windows ago", current - 2, false},
+		{"two windows ahead", current + 2, false},
+	}
+	for _, tt := range tests {
+		if got := p.checkToken(addr, "user1", computeToken(secret, tt.index, addr)); got != tt.want {
+			t.Errorf("%s: checkToken = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !p.checkToken(addr, "user1", p.Token(addr)) {
+		t.Error("checkToken rejected the token just issued")
+	}
+}
+
+func TestTokenBoundToAddress(t *testing.T) {
+	p := newTestTokenProvider(t, "secret", 5)
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	token := p.Token(addr)
+	tests := []struct {
+		name string
+		addr *net.UDPAddr
+		want bool
+	}{
+		// 双栈socket收到的IPv4-mapped地址与IPv4地址得到相同的token
+		{"ipv4-mapped", &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 40000}, true},
+		{"different ip", &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}, false},
+		{"different port", &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}, false},
+	}
+	for _, tt := range tests {
+		if got := p.checkToken(tt.addr, "user1", token); got != tt.want {
+			t.Errorf("%s: checkToken = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 配置相同token_secret的实例可以互相校验，secret不同或更换后旧token失效
+func TestTokenSecret(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	a := newTestTokenProvider(t, "secret", 5)
+	b := newTestTokenProvider(t, "secret", 5)
+	if !b.checkToken(addr, "user1", a.Token(addr)) {
+		t.Error("instance with the same secret rejected the token")
+	}
+	other := newTestTokenProvider(t, "other", 5)
+	if other.checkToken(addr, "user1", a.Token(addr)) {
+		t.Error("instance with a different secret accepted the token")
+	}
+	token := a.Token(addr)
+	conf.Xml.Auth.TokenSecret = "rotated"
+	a.Reload()
+	if a.checkToken(addr, "user1", token) {
+		t.Error("token issued before Reload still accepted")
+	}
+	// 没有配置secret时每个实例使用自己的随机密钥
+	x := newTestTokenProvider(t, "", 5)
+	y := newTestTokenProvider(t, "", 5)
+	if y.checkToken(addr, "user1", x.Token(addr)) {
+		t.Error("random secrets of two instances matched")
+	}
+}
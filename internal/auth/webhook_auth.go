@@ -0,0 +1,248 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"relay/internal/conf"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const maxWebhookCacheSize = 10000
+
+// WebhookAuthenticator 向外部HTTP服务查询用户的密钥和限速，接入已有的账号系统。
+//
+// 请求为POST JSON：{"username": "...", "type": "create_room", "addr": "ip:port", "room": "..."}，
+// type为create_room/join_room/leave_room/rebind，只查询密钥或限速时为key。
+// 200表示用户存在，回复{"key": "...", "req_to_resp": 0, "resp_to_req": 0}；
+// 403/404表示用户不存在或被禁止，其他状态码和超时都按查询失败处理，不缓存。
+// 结果缓存cache_ttl秒：是否允许按用户名和IP缓存，不包含端口，客户端换了端口或者NAT映射变化后仍然命中缓存；
+// 200回复中的密钥和限速按用户名另存一份，签名和限速时直接使用，同一个请求不会查询两次。
+// 查询在worker中同步进行，timeout不宜过长
+type WebhookAuthenticator struct {
+	*verifier
+	mutex    sync.Mutex // 保护缓存和配置
+	client   *http.Client
+	url      string
+	cacheTTL time.Duration
+	cache    map[string]webhookEntry
+	// order 按插入顺序记录缓存的key，有效期相同，所以也是过期顺序
+	order []webhookCacheItem
+}
+
+type webhookEntry struct {
+	found    bool
+	key      string
+	limit    Limit
+	expireAt time.Time
+}
+
+type webhookCacheItem struct {
+	key      string
+	expireAt time.Time
+}
+
+type webhookRequest struct {
+	Username string `json:"username"`
+	Type     string `json:"type"`
+	Addr     string `json:"addr,omitempty"`
+	Room     string `json:"room,omitempty"`
+	// ip 不发给外部服务，只用于缓存
+	ip string
+}
+
+type webhookResponse struct {
+	Key       string `json:"key"`
+	ReqToResp uint32 `json:"req_to_resp"`
+	RespToReq uint32 `json:"resp_to_req"`
+}
+
+func init() {
+	Register("webhook", NewWebhookAuthenticator)
+}
+
+func NewWebhookAuthenticator() Authenticator {
+	a := &WebhookAuthenticator{
+		cache: make(map[string]webhookEntry),
+	}
+	a.verifier = newVerifier(a.requestKey)
+	a.loadConfig()
+	return a
+}
+
+func (a *WebhookAuthenticator) loadConfig() {
+	cfg := conf.Xml.Auth.Webhook
+	timeout := time.Duration(cfg.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	cacheTTL := time.Duration(cfg.CacheTTL) * time.Second
+	if cacheTTL <= 0 {
+		cacheTTL = time.Minute
+	}
+	a.client = &http.Client{Timeout: timeout}
+	a.url = cfg.URL
+	a.cacheTTL = cacheTTL
+}
+
+// Reload 重新读取webhook配置并清空缓存，让账号系统中的修改立即生效
+func (a *WebhookAuthenticator) Reload() {
+	a.verifier.Reload()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.loadConfig()
+	a.cache = make(map[string]webhookEntry)
+	a.order = nil
+}
+
+// requestKey 把请求的类型、地址和room一起发给外部服务，外部服务可以记录下来
+func (a *WebhookAuthenticator) requestKey(addr *net.UDPAddr, request *authRequest) (string, bool) {
+	entry, ok := a.lookup(newWebhookRequest(request.username, request.kind, addr, request.room))
+	if !ok || !entry.found {
+		return "", false
+	}
+	return entry.key, true
+}
+
+func (a *WebhookAuthenticator) Limit(username string) Limit {
+	entry, ok := a.lookup(webhookRequest{Username: username, Type: "key"})
+	if !ok || !entry.found {
+		return Limit{}
+	}
+	return entry.limit
+}
+
+func (a *WebhookAuthenticator) Key(username string) (string, bool) {
+	entry, ok := a.lookup(webhookRequest{Username: username, Type: "key"})
+	if !ok || !entry.found {
+		return "", false
+	}
+	return entry.key, true
+}
+
+func newWebhookRequest(username string, requestType string, addr *net.UDPAddr, room uuid.UUID) webhookRequest {
+	request := webhookRequest{
+		Username: username,
+		Type:     requestType,
+		Addr:     addr.String(),
+		ip:       addr.IP.String(),
+	}
+	if room != (uuid.UUID{}) {
+		request.Room = room.String()
+	}
+	return request
+}
+
+// cacheKey 同一用户从同一IP发来的请求共用一个结果；type为key时没有地址，只有用户名
+func (request webhookRequest) cacheKey() string {
+	return request.Username + "|" + request.ip
+}
+
+// lookup 优先使用缓存，查询失败时返回false
+func (a *WebhookAuthenticator) lookup(request webhookRequest) (webhookEntry, bool) {
+	a.mutex.Lock()
+	entry, exists := a.cache[request.cacheKey()]
+	client, url, cacheTTL := a.client, a.url, a.cacheTTL
+	a.mutex.Unlock()
+	now := time.Now()
+	if exists && now.Before(entry.expireAt) {
+		return entry, true
+	}
+	entry, err := queryWebhook(client, url, request)
+	if err != nil {
+		logrus.Warnf("Query webhook for user %s failed: %v", request.Username, err)
+		return webhookEntry{}, false
+	}
+	entry.expireAt = now.Add(cacheTTL)
+	a.mutex.Lock()
+	a.put(request.cacheKey(), entry, now)
+	if entry.found && request.ip != "" {
+		a.put(webhookRequest{Username: request.Username}.cacheKey(), entry, now)
+	}
+	a.mutex.Unlock()
+	return entry, true
+}
+
+// put 先清理过期的缓存，仍然满了时淘汰最早的缓存，调用时需要持有mutex
+func (a *WebhookAuthenticator) put(key string, entry webhookEntry, now time.Time) {
+	for len(a.order) != 0 && (len(a.cache) >= maxWebhookCacheSize || !now.Before(a.order[0].expireAt)) {
+		oldest := a.order[0]
+		a.order = a.order[1:]
+		// 过期后重新查询的key在order中有多条记录，只有最新的一条对应缓存
+		if cached, exists := a.cache[oldest.key]; exists && cached.expireAt.Equal(oldest.expireAt) {
+			delete(a.cache, oldest.key)
+		}
+	}
+	a.cache[key] = entry
+	a.order = append(a.order, webhookCacheItem{key: key, expireAt: entry.expireAt})
+}
+
+func queryWebhook(client *http.Client, url string, request webhookRequest) (webhookEntry, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return webhookEntry{}, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return webhookEntry{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotFound:
+		return webhookEntry{found: false}, nil
+	default:
+		return webhookEntry{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var response webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return webhookEntry{}, err
+	}
+	if response.Key == "" {
+		return webhookEntry{}, fmt.Errorf("empty key")
+	}
+	return webhookEntry{
+		found: true,
+		key:   response.Key,
+		limit: Limit{
+			ReqToResp: response.ReqToResp,
+			RespToReq: response.RespToReq,
+		},
+	}, nil
+}
@@ -0,0 +1,197 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"relay/internal/conf"
+	"relay/internal/msg"
+)
+
+// newTestWebhook user1允许，denied返回403，slow超过timeout才回复
+func newTestWebhook(t *testing.T) (*WebhookAuthenticator, *atomic.Int32) {
+	t.Helper()
+	calls := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var request webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch request.Username {
+		case "user1":
+			json.NewEncoder(w).Encode(webhookResponse{Key: "password1", ReqToResp: 100, RespToReq: 200})
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			json.NewEncoder(w).Encode(webhookResponse{Key: "password1"})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(server.Close)
+	old := conf.Xml.Auth.Webhook
+	conf.Xml.Auth.Webhook.URL = server.URL
+	conf.Xml.Auth.Webhook.Timeout = 50
+	conf.Xml.Auth.Webhook.CacheTTL = 60
+	t.Cleanup(func() { conf.Xml.Auth.Webhook = old })
+	a := NewWebhookAuthenticator().(*WebhookAuthenticator)
+	return a, calls
+}
+
+func webhookCreate(a *WebhookAuthenticator, addr *net.UDPAddr, username string) Result {
+	data := signed((&msg.CreateRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: username,
+		Time: time.Now(), IP: addr.IP, Port: uint32(addr.Port), Token: a.Token(addr)}).ToBytes(), "password1")
+	return a.Auth(addr, msg.ParseCreateRoomRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize])
+}
+
+func webhookJoin(a *WebhookAuthenticator, addr *net.UDPAddr, username string, room uuid.UUID) Result {
+	data := signed((&msg.JoinRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: username,
+		Time: time.Now(), IP: addr.IP, Port: uint32(addr.Port), Token: a.Token(addr), Room: room}).ToBytes(), "password1")
+	return a.AuthJoin(addr, msg.ParseJoinRoomRequest(data), data[:msg.BaseMessageSize-msg.IntegritySize])
+}
+
+func TestWebhookAllow(t *testing.T) {
+	a, calls := newTestWebhook(t)
+	result := webhookCreate(a, testAddr, "user1")
+	if result.ErrCode != msg.Err_OK || result.Key != "password1" {
+		t.Fatalf("Auth = %+v, want Err_OK with key", result)
+	}
+	// 签名和限速使用同一次查询的结果
+	if key, exists := a.Key("user1"); !exists || key != "password1" {
+		t.Fatalf("Key = %q, %v", key, exists)
+	}
+	if limit := a.Limit("user1"); limit != (Limit{ReqToResp: 100, RespToReq: 200}) {
+		t.Fatalf("Limit = %+v", limit)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("webhook called %d times, want 1", n)
+	}
+}
+
+func TestWebhookDeny(t *testing.T) {
+	a, calls := newTestWebhook(t)
+	for i := 0; i < 2; i++ {
+		if result := webhookCreate(a, testAddr, "denied"); result.ErrCode != msg.Err_AuthFailed || result.Key != "" {
+			t.Fatalf("Auth = %+v, want Err_AuthFailed without key", result)
+		}
+	}
+	// 403也会缓存
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("webhook called %d times, want 1", n)
+	}
+	if _, exists := a.Key("denied"); exists {
+		t.Fatal("Key found a denied user")
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	a, calls := newTestWebhook(t)
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if result := webhookCreate(a, testAddr, "slow"); result.ErrCode != msg.Err_AuthFailed {
+			t.Fatalf("Auth = %+v, want Err_AuthFailed", result)
+		}
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Fatalf("Auth took %v, timeout not applied", elapsed)
+		}
+	}
+	// 查询失败不缓存
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("webhook called %d times, want 2", n)
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	a, calls := newTestWebhook(t)
+	webhookCreate(a, testAddr, "user1")
+	// 同一IP换了端口、换了请求类型或room都使用缓存
+	otherPort := &net.UDPAddr{IP: testAddr.IP, Port: testAddr.Port + 1}
+	if result := webhookCreate(a, otherPort, "user1"); result.ErrCode != msg.Err_OK {
+		t.Fatalf("Auth from another port = %+v", result)
+	}
+	webhookJoin(a, otherPort, "user1", uuid.New())
+	webhookJoin(a, testAddr, "user1", uuid.New())
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("webhook called %d times from the same IP, want 1", n)
+	}
+	if len(a.cache) != 2 {
+		t.Fatalf("cache size = %d, want 2", len(a.cache))
+	}
+	// 不同的IP需要重新查询
+	webhookCreate(a, &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: testAddr.Port}, "user1")
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("webhook called %d times, want 2", n)
+	}
+	a.Reload()
+	webhookCreate(a, testAddr, "user1")
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("webhook called %d times after Reload, want 3", n)
+	}
+}
+
+func TestWebhookCacheEvictOldest(t *testing.T) {
+	a, _ := newTestWebhook(t)
+	now := time.Now()
+	entry := webhookEntry{found: true, key: "key", expireAt: now.Add(time.Minute)}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for i := 0; i <= maxWebhookCacheSize; i++ {
+		a.put(fmt.Sprintf("user%d", i), entry, now)
+	}
+	if len(a.cache) != maxWebhookCacheSize {
+		t.Fatalf("cache size = %d, want %d", len(a.cache), maxWebhookCacheSize)
+	}
+	if _, exists := a.cache["user0"]; exists {
+		t.Fatal("oldest entry not evicted")
+	}
+	for _, key := range []string{"user1", fmt.Sprintf("user%d", maxWebhookCacheSize)} {
+		if _, exists := a.cache[key]; !exists {
+			t.Fatalf("entry %s evicted", key)
+		}
+	}
+	// 过期的缓存先被清理
+	later := now.Add(2 * time.Minute)
+	a.put("new", webhookEntry{found: true, expireAt: later.Add(time.Minute)}, later)
+	if len(a.cache) != 1 {
+		t.Fatalf("cache size = %d after expiry, want 1", len(a.cache))
+	}
+}
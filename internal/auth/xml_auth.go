@@ -1,121 +1,97 @@
 package auth
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/binary"
-	"net"
 	"relay/internal/common"
 	"relay/internal/conf"
-	"relay/internal/msg"
 	"sync"
-	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type XmlAuthenticator struct {
-	lastToken     string
-	currToken     string
-	validDuration time.Duration
-	stopChan      chan struct{}
-	mutex         sync.Mutex
-	users         map[string]string
+	*verifier
+	mutex  sync.Mutex
+	users  map[string]string
+	limits map[string]Limit
+}
+
+func init() {
+	Register("xml", NewXmlAuthenticator)
 }
 
 func NewXmlAuthenticator() Authenticator {
-	token := common.RandStr(common.Fixed16)
-	a := &XmlAuthenticator{
-		lastToken:     token,
-		currToken:     token,
-		validDuration: time.Second * 5,
-		users:         make(map[string]string),
-	}
+	a := &XmlAuthenticator{}
+	a.verifier = newVerifier(keyByUsername(a.Key))
 	if !a.init() {
 		return nil
 	}
-	go a.changeToken()
 	return a
 }
 
-func (a *XmlAuthenticator) changeToken() {
-	ticker := time.NewTicker(a.validDuration)
-	for {
-		select {
-		case <-a.stopChan:
-			return
-		case <-ticker.C:
-			a.mutex.Lock()
-			a.lastToken = a.currToken
-			a.currToken = common.RandStr(common.Fixed16)
-			a.mutex.Unlock()
-		}
+func (a *XmlAuthenticator) init() bool {
+	users, limits, ok := loadXmlUsers()
+	if !ok {
+		return false
 	}
+	a.users = users
+	a.limits = limits
+	return true
 }
 
-func (a *XmlAuthenticator) init() bool {
+// Reload 重新读取conf.Xml中的用户，已经建立的session不受影响
+func (a *XmlAuthenticator) Reload() {
+	a.verifier.Reload()
+	users, limits, ok := loadXmlUsers()
+	if !ok {
+		logrus.Error("Reload xml users failed, keep using the old ones")
+		return
+	}
+	a.mutex.Lock()
+	a.users = users
+	a.limits = limits
+	a.mutex.Unlock()
+}
+
+func loadXmlUsers() (map[string]string, map[string]Limit, bool) {
 	if len(conf.Xml.Auth.Users) == 0 {
-		return false
+		return nil, nil, false
 	}
+	users := make(map[string]string)
+	limits := make(map[string]Limit)
 	for i := 0; i < len(conf.Xml.Auth.Users); i++ {
 		length := len(conf.Xml.Auth.Users[i].Username)
 		if length > common.Fixed16 {
 			logrus.Errorf("Username '%s' too long, must be <= 16 bytes", conf.Xml.Auth.Users[i].Username)
-			return false
+			return nil, nil, false
 		}
 		length = len(conf.Xml.Auth.Users[i].Password)
 		if length > common.Fixed16 {
 			logrus.Errorf("Password for user '%s' too long, must be <= 16 bytes", conf.Xml.Auth.Users[i].Username)
-			return false
+			return nil, nil, false
 		}
-		_, exists := a.users[conf.Xml.Auth.Users[i].Password]
+		_, exists := users[conf.Xml.Auth.Users[i].Username]
 		if exists {
 			logrus.Errorf("Username '%s' duplicated", conf.Xml.Auth.Users[i].Username)
-			return false
+			return nil, nil, false
+		}
+		users[conf.Xml.Auth.Users[i].Username] = conf.Xml.Auth.Users[i].Password
+		limits[conf.Xml.Auth.Users[i].Username] = Limit{
+			ReqToResp: conf.Xml.Auth.Users[i].ReqToResp,
+			RespToReq: conf.Xml.Auth.Users[i].RespToReq,
 		}
-		a.users[conf.Xml.Auth.Users[i].Username] = conf.Xml.Auth.Users[i].Password
 	}
-	return true
-}
-
-func (a *XmlAuthenticator) Stop() {
-	a.stopChan <- struct{}{}
+	return users, limits, true
 }
 
-func (a *XmlAuthenticator) Token() string {
+func (a *XmlAuthenticator) Limit(username string) Limit {
 	a.mutex.Lock()
-	token := a.currToken
-	a.mutex.Unlock()
-	return token
+	defer a.mutex.Unlock()
+	return a.limits[username]
 }
 
-func (a *XmlAuthenticator) Auth(addr *net.UDPAddr, request *msg.CreateRoomRequest, data []byte) int32 {
+func (a *XmlAuthenticator) Key(username string) (string, bool) {
 	a.mutex.Lock()
-	lastToken := a.lastToken
-	currToken := a.currToken
-	a.mutex.Unlock()
-	// 校验Token
-	if lastToken != request.Token && currToken != request.Token {
-		logrus.Warnf("Packet(user:%s) token invalid", request.Username)
-		return msg.Err_AuthFailed
-	}
-	// 如果不校验IP:Port，其他人捕获到合法的CreateRoomRequest包，发出一模一样的内容，也能使用relay服务器的资源
-	if request.IP != binary.LittleEndian.Uint32(addr.IP) || request.Port != uint32(addr.Port) {
-		logrus.Warnf("Packet(user:%s) address invalid", request.Username)
-		return msg.Err_AddressInvalid
-	}
-	// 校验hmac
-	passwd, exists := a.users[request.Username]
-	if !exists {
-		return msg.Err_AuthFailed
-	}
-	h := hmac.New(sha1.New, []byte(passwd))
-	h.Write(data)
-	sum := string(h.Sum(nil))
-	logrus.Debug("Integrity:", request.Integrity, ", Sum:", sum)
-	if request.Integrity == sum {
-		return msg.Err_OK
-	} else {
-		return msg.Err_AuthFailed
-	}
+	defer a.mutex.Unlock()
+	passwd, exists := a.users[username]
+	return passwd, exists
 }
@@ -32,9 +32,13 @@ package conf
 
 import (
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 )
 
 const defaultXmlPath = "relay.xml"
@@ -53,6 +57,9 @@ const defaultXmlConfig = `
     <net>
         <ip>0.0.0.0</ip>
         <port>19000</port>
+        <workers>0</workers>
+        <batch>32</batch>
+        <drain_timeout>30</drain_timeout>
     </net>
 
     <mgr>
@@ -62,9 +69,41 @@ const defaultXmlConfig = `
         <mode>release</mode>
     </mgr>
 
+    <ratelimit>
+        <policy>drop</policy>
+        <queue_size>256</queue_size>
+        <session_req_to_resp>0</session_req_to_resp>
+        <session_resp_to_req>0</session_resp_to_req>
+        <user_req_to_resp>0</user_req_to_resp>
+        <user_resp_to_req>0</user_resp_to_req>
+        <control_per_ip>20</control_per_ip>
+        <control_global>10000</control_global>
+    </ratelimit>
+
+    <session>
+        <idle_timeout>30</idle_timeout>
+        <half_open_timeout>60</half_open_timeout>
+        <max_duration>0</max_duration>
+        <sweep_interval>5</sweep_interval>
+        <keepalive_interval>10</keepalive_interval>
+    </session>
+
+    <ban>
+        <max_failures>10</max_failures>
+        <window>60</window>
+        <ban_time>60</ban_time>
+        <max_ban_time>3600</max_ban_time>
+        <allow>
+            <cidr>127.0.0.1/32</cidr>
+            <cidr>::1/128</cidr>
+        </allow>
+    </ban>
+
     <auth>
 		<use_db>false</use_db>
 		<db>user.db</db>
+		<max_time_skew>300</max_time_skew>
+		<replay_cache_size>10000</replay_cache_size>
 		<users>
 			<user>
 				<username>user1</username>
@@ -82,11 +121,41 @@ const defaultXmlConfig = `
 
 var Xml relayConf
 
+// xmlPath 启动时指定的配置文件路径，重新加载时使用
+var xmlPath string
+
+// restartRequired 修改后需要重启才能生效的配置项，重新加载时保持原值
+var restartRequired = map[string]bool{
+	"log.path":    true,
+	"log.prefix":  true,
+	"log.maxsize": true,
+	"log.maxage":  true,
+	"net.ip":      true,
+	"net.port":    true,
+	"net.workers": true,
+	"net.batch":   true,
+	"auth.type":   true,
+	"auth.use_db": true,
+	"auth.db":     true,
+	// 修改master key后旧的密文无法解密
+	"auth.master_key": true,
+}
+
+// secretFields 输出变化时不打印值的配置项
+var secretFields = map[string]bool{
+	"auth.master_key":    true,
+	"auth.shared_secret": true,
+	"auth.token_secret":  true,
+}
+
 type relayConf struct {
-	Log  logConf  `xml:"log"`
-	Net  netConf  `xml:"net"`
-	Mgr  mgrConf  `xml:"mgr"`
-	Auth authConf `xml:"auth"`
+	Log       logConf       `xml:"log"`
+	Net       netConf       `xml:"net"`
+	Mgr       mgrConf       `xml:"mgr"`
+	RateLimit rateLimitConf `xml:"ratelimit"`
+	Session   sessionConf   `xml:"session"`
+	Ban       banConf       `xml:"ban"`
+	Auth      authConf      `xml:"auth"`
 }
 
 type logConf struct {
@@ -100,6 +169,13 @@ type logConf struct {
 type netConf struct {
 	ListenPort uint16 `xml:"port"`
 	ListenIP   string `xml:"ip"`
+	Workers    int    `xml:"workers"`
+	Batch      int    `xml:"batch"`
+	// 收到SIGTERM后等待已有room结束的最长时间(秒)，0表示立即退出
+	DrainTimeout int `xml:"drain_timeout"`
+	// 允许和拒绝的客户端网段，deny优先，allow为空表示允许所有不在deny中的地址
+	Allow []string `xml:"allow>cidr"`
+	Deny  []string `xml:"deny>cidr"`
 }
 
 type mgrConf struct {
@@ -109,25 +185,95 @@ type mgrConf struct {
 	Mode       string `xml:"mode"`
 }
 
+// 限速单位均为kbps，0表示不限速。
+// req指申请room的一方，resp指加入room的一方
+type rateLimitConf struct {
+	Policy           string `xml:"policy"`     // drop或queue
+	QueueSize        int    `xml:"queue_size"` // policy为queue时每个方向最多缓存的包数
+	SessionReqToResp uint32 `xml:"session_req_to_resp"`
+	SessionRespToReq uint32 `xml:"session_resp_to_req"`
+	UserReqToResp    uint32 `xml:"user_req_to_resp"` // 同一用户所有session之和
+	UserRespToReq    uint32 `xml:"user_resp_to_req"`
+	// 每秒最多处理的控制消息数，超过的直接丢弃，0表示不限制
+	ControlPerIP  uint32 `xml:"control_per_ip"` // 同一来源IP
+	ControlGlobal uint32 `xml:"control_global"` // 所有来源之和
+}
+
+// 单位均为秒。idle_timeout和sweep_interval为0时使用默认值30和5，其他为0表示不限制
+type sessionConf struct {
+	IdleTimeout       int `xml:"idle_timeout"`       // 两个方向都没有数据超过这个时间后关闭
+	HalfOpenTimeout   int `xml:"half_open_timeout"`  // 创建之后超过这个时间还没有人加入则关闭
+	MaxDuration       int `xml:"max_duration"`       // 从创建开始超过这个时间后关闭
+	SweepInterval     int `xml:"sweep_interval"`     // 检查超时的间隔
+	KeepaliveInterval int `xml:"keepalive_interval"` // 向VersionThree的客户端发送keepalive测量RTT的间隔，0表示不发送
+}
+
+// banConf 同一个IP或用户名在window秒内验证失败max_failures次后封禁ban_time秒，
+// 每次再被封禁时间加倍，最长max_ban_time秒。max_failures为0表示不封禁
+type banConf struct {
+	MaxFailures int      `xml:"max_failures"`
+	Window      int      `xml:"window"`       // 0表示默认的60
+	BanTime     int      `xml:"ban_time"`     // 0表示默认的60
+	MaxBanTime  int      `xml:"max_ban_time"` // 0表示默认的3600
+	Allow       []string `xml:"allow>cidr"`   // 永远不会被封禁的网段
+}
+
 type userEntry struct {
-	Username string `xml:"username"`
-	Password string `xml:"password"`
+	Username  string `xml:"username"`
+	Password  string `xml:"password"`
+	ReqToResp uint32 `xml:"req_to_resp"` // 覆盖ratelimit中的user_req_to_resp
+	RespToReq uint32 `xml:"resp_to_req"` // 覆盖ratelimit中的user_resp_to_req
+	// 该用户的客户端地址还需要满足的网段限制，与验证方式无关
+	Allow []string `xml:"allow>cidr"`
+	Deny  []string `xml:"deny>cidr"`
 }
 
 type authConf struct {
-	UseDB bool        `xml:"use_db"`
-	DB    string      `xml:"db"`
-	Users []userEntry `xml:"users>user"`
+	Type            string      `xml:"type"` // 验证方式，为空时按use_db选择db或xml
+	UseDB           bool        `xml:"use_db"`
+	DB              string      `xml:"db"`
+	MaxTimeSkew     int         `xml:"max_time_skew"`     // 请求时间与服务器时间最大相差多少秒，0表示不校验
+	ReplayCacheSize int         `xml:"replay_cache_size"` // 防重放缓存最多记录多少个请求
+	MasterKey       string      `xml:"master_key"`        // 加密数据库中密码的密钥，为空时明文保存
+	TokenSecret     string      `xml:"token_secret"`      // 计算reflex token的密钥，集群中的实例需要相同，为空时随机生成
+	TokenWindow     int         `xml:"token_window"`      // reflex token的时间窗口，单位秒，0表示默认的5
+	Webhook         webhookConf `xml:"webhook"`
+	SharedSecret    string      `xml:"shared_secret"` // type为turn_rest时，签发临时凭证的密钥
+	Users           []userEntry `xml:"users>user"`
+}
+
+// webhookConf type为webhook时，向url查询用户的密钥和限速
+type webhookConf struct {
+	URL      string `xml:"url"`
+	Timeout  int    `xml:"timeout"`   // 毫秒，0表示默认的1000
+	CacheTTL int    `xml:"cache_ttl"` // 查询结果缓存多少秒，0表示默认的60
 }
 
+// AuthType 返回实际使用的验证方式，兼容没有type只有use_db的旧配置
+func (c *authConf) AuthType() string {
+	if c.Type != "" {
+		return strings.ToLower(c.Type)
+	}
+	if c.UseDB {
+		return "db"
+	}
+	return "xml"
+}
+
+// init 先加载默认配置，命令行指定的配置文件由Init加载
 func init() {
-	xmlPath := flag.String("c", defaultXmlPath, "配置文件路径")
-	flag.Parse()
-	if err := loadConfig(*xmlPath); err != nil {
+	if err := xml.Unmarshal([]byte(defaultXmlConfig), &Xml); err != nil {
 		panic(err)
 	}
 }
 
+// Init 解析命令行参数并加载配置文件，main在使用配置前调用
+func Init() error {
+	flag.StringVar(&xmlPath, "c", defaultXmlPath, "配置文件路径")
+	flag.Parse()
+	return loadConfig(xmlPath)
+}
+
 func loadConfig(xmlPath string) error {
 	content, err := os.ReadFile(xmlPath)
 	if err != nil {
@@ -139,6 +285,181 @@ func loadConfig(xmlPath string) error {
 	if err != nil {
 		return err
 	}
+	if err = validate(&cfg); err != nil {
+		return err
+	}
+	Xml = cfg
+	return nil
+}
+
+// Reload 重新读取配置文件，校验失败时保持原配置不变。
+// 返回变化了的配置项，需要重启才能生效的配置项保持原值
+func Reload() ([]string, error) {
+	content, err := os.ReadFile(xmlPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg := relayConf{}
+	if err = xml.Unmarshal(content, &cfg); err != nil {
+		return nil, err
+	}
+	changes := diff(&Xml, &cfg)
+	// 需要重启的配置项已经恢复成原值，校验的是实际生效的组合，
+	// 比如新文件同时打开use_db和mgr，但use_db要重启才能生效
+	if err = validate(&cfg); err != nil {
+		return nil, err
+	}
 	Xml = cfg
+	return changes, nil
+}
+
+func validate(cfg *relayConf) error {
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug", "info", "warn", "warning", "error", "fatal", "panic":
+	default:
+		return fmt.Errorf("unknown log level '%s'", cfg.Log.Level)
+	}
+	if net.ParseIP(cfg.Net.ListenIP) == nil {
+		return fmt.Errorf("invalid listen ip '%s'", cfg.Net.ListenIP)
+	}
+	if cfg.Mgr.Enable && !cfg.Auth.UseDB {
+		return errors.New("mgr can only be enabled with use_db")
+	}
+	switch strings.ToLower(cfg.RateLimit.Policy) {
+	case "", "drop", "queue":
+	default:
+		return fmt.Errorf("unknown ratelimit policy '%s'", cfg.RateLimit.Policy)
+	}
+	if cfg.RateLimit.QueueSize < 0 || cfg.Auth.MaxTimeSkew < 0 || cfg.Auth.ReplayCacheSize < 0 || cfg.Auth.TokenWindow < 0 || cfg.Net.DrainTimeout < 0 {
+		return errors.New("queue_size, max_time_skew, replay_cache_size, token_window and drain_timeout must not be negative")
+	}
+	if cfg.Session.IdleTimeout < 0 || cfg.Session.HalfOpenTimeout < 0 || cfg.Session.MaxDuration < 0 || cfg.Session.SweepInterval < 0 || cfg.Session.KeepaliveInterval < 0 {
+		return errors.New("session timeouts must not be negative")
+	}
+	if cfg.Ban.MaxFailures < 0 || cfg.Ban.Window < 0 || cfg.Ban.BanTime < 0 || cfg.Ban.MaxBanTime < 0 {
+		return errors.New("ban max_failures, window, ban_time and max_ban_time must not be negative")
+	}
+	if err := validateCIDRs(cfg.Ban.Allow); err != nil {
+		return fmt.Errorf("ban: %v", err)
+	}
+	if err := validateCIDRs(cfg.Net.Allow, cfg.Net.Deny); err != nil {
+		return fmt.Errorf("net: %v", err)
+	}
+	for _, user := range cfg.Auth.Users {
+		if err := validateCIDRs(user.Allow, user.Deny); err != nil {
+			return fmt.Errorf("user '%s': %v", user.Username, err)
+		}
+	}
+	// 其他类型由auth包注册，创建时再检查
+	switch cfg.Auth.AuthType() {
+	case "xml":
+		if len(cfg.Auth.Users) == 0 {
+			return errors.New("no users configured")
+		}
+	case "db":
+		// 数据库只在use_db为true时打开
+		if !cfg.Auth.UseDB {
+			return errors.New("auth type db requires use_db")
+		}
+	case "webhook":
+		if cfg.Auth.Webhook.URL == "" {
+			return errors.New("auth type webhook requires webhook url")
+		}
+		if cfg.Auth.Webhook.Timeout < 0 || cfg.Auth.Webhook.CacheTTL < 0 {
+			return errors.New("webhook timeout and cache_ttl must not be negative")
+		}
+	case "turn_rest":
+		if cfg.Auth.SharedSecret == "" {
+			return errors.New("auth type turn_rest requires shared_secret")
+		}
+	}
+	// 其他验证方式下<user>只用来配置网段限制，用户名同样不能为空或重复
+	usernames := make(map[string]bool)
+	for _, user := range cfg.Auth.Users {
+		if user.Username == "" || len(user.Username) > 16 || len(user.Password) > 16 {
+			return fmt.Errorf("username '%s' or its password empty or longer than 16 bytes", user.Username)
+		}
+		if usernames[user.Username] {
+			return fmt.Errorf("username '%s' duplicated", user.Username)
+		}
+		usernames[user.Username] = true
+	}
+	return nil
+}
+
+func validateCIDRs(lists ...[]string) error {
+	for _, cidrs := range lists {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid cidr '%s'", cidr)
+			}
+		}
+	}
 	return nil
 }
+
+// diff 按"section.name: old -> new"的格式列出变化的配置项，用户只列出用户名，不输出密码和密钥
+func diff(old *relayConf, cfg *relayConf) []string {
+	var changes []string
+	oldConf := reflect.ValueOf(old).Elem()
+	newConf := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < oldConf.NumField(); i++ {
+		section := oldConf.Type().Field(i).Tag.Get("xml")
+		oldSection := oldConf.Field(i)
+		newSection := newConf.Field(i)
+		for j := 0; j < oldSection.NumField(); j++ {
+			field := oldSection.Type().Field(j)
+			name := section + "." + strings.Split(field.Tag.Get("xml"), ">")[0]
+			oldValue := oldSection.Field(j)
+			newValue := newSection.Field(j)
+			if reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+				continue
+			}
+			change := fmt.Sprintf("%s: %v -> %v", name, oldValue, newValue)
+			if secretFields[name] {
+				change = name + " changed"
+			}
+			if name == "auth.users" {
+				changes = append(changes, diffUsers(old.Auth.Users, cfg.Auth.Users)...)
+			} else if restartRequired[name] {
+				changes = append(changes, change+" (requires restart, ignored)")
+				newValue.Set(oldValue)
+			} else {
+				changes = append(changes, change)
+			}
+		}
+	}
+	return changes
+}
+
+func diffUsers(oldUsers []userEntry, newUsers []userEntry) []string {
+	var changes []string
+	users := make(map[string]userEntry)
+	for _, user := range oldUsers {
+		users[user.Username] = user
+	}
+	for _, user := range newUsers {
+		oldUser, exists := users[user.Username]
+		if !exists {
+			changes = append(changes, fmt.Sprintf("auth.users: user '%s' added", user.Username))
+		} else if oldUser.Password != user.Password {
+			changes = append(changes, fmt.Sprintf("auth.users: user '%s' password changed", user.Username))
+		} else {
+			if oldUser.ReqToResp != user.ReqToResp || oldUser.RespToReq != user.RespToReq {
+				changes = append(changes, fmt.Sprintf("auth.users: user '%s' limit %d/%d -> %d/%d", user.Username,
+					oldUser.ReqToResp, oldUser.RespToReq, user.ReqToResp, user.RespToReq))
+			}
+			if !reflect.DeepEqual(oldUser.Allow, user.Allow) || !reflect.DeepEqual(oldUser.Deny, user.Deny) {
+				changes = append(changes, fmt.Sprintf("auth.users: user '%s' allow %v -> %v, deny %v -> %v", user.Username,
+					oldUser.Allow, user.Allow, oldUser.Deny, user.Deny))
+			}
+		}
+		delete(users, user.Username)
+	}
+	for _, user := range oldUsers {
+		if _, exists := users[user.Username]; exists {
+			changes = append(changes, fmt.Sprintf("auth.users: user '%s' removed", user.Username))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,96 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package conf
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, content string) relayConf {
+	t.Helper()
+	cfg := relayConf{}
+	if err := xml.Unmarshal([]byte(content), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// 新文件单独校验可以通过，但use_db需要重启，实际生效的组合是没有use_db却打开了mgr
+func TestReloadValidatesMergedConfig(t *testing.T) {
+	content := strings.Replace(defaultXmlConfig, "<use_db>false</use_db>", "<use_db>true</use_db>", 1)
+	content = strings.Replace(content, "<enable>false</enable>", "<enable>true</enable>", 1)
+	cfg := parse(t, content)
+	if err := validate(&cfg); err != nil {
+		t.Fatalf("new config alone should be valid: %v", err)
+	}
+	Xml = parse(t, defaultXmlConfig)
+	xmlPath = filepath.Join(t.TempDir(), "relay.xml")
+	if err := os.WriteFile(xmlPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Reload(); err == nil {
+		t.Fatal("Reload accepted mgr.enable with use_db reverted to false")
+	}
+	if Xml.Mgr.Enable || Xml.Auth.UseDB {
+		t.Fatal("failed Reload modified Xml")
+	}
+}
+
+func TestValidateUsersForAllAuthTypes(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+	}{
+		{"xml", ""},
+		{"webhook", "<type>webhook</type><webhook><url>http://127.0.0.1/auth</url></webhook>"},
+		{"turn_rest", "<type>turn_rest</type><shared_secret>secret</shared_secret>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := strings.Replace(defaultXmlConfig, "<use_db>false</use_db>", "<use_db>false</use_db>"+tt.extra, 1)
+			cfg := parse(t, content)
+			if cfg.Auth.AuthType() != tt.name {
+				t.Fatalf("AuthType = %s", cfg.Auth.AuthType())
+			}
+			if err := validate(&cfg); err != nil {
+				t.Fatalf("validate: %v", err)
+			}
+			cfg = parse(t, strings.Replace(content, "<username>user2</username>", "<username>user1</username>", 1))
+			if err := validate(&cfg); err == nil {
+				t.Fatal("validate accepted duplicated usernames")
+			}
+		})
+	}
+}
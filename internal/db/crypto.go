@@ -0,0 +1,104 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// 加密后的密码格式为 encryptedPrefix + base64(nonce + 密文)，没有前缀的是旧版本的明文
+const encryptedPrefix = "aesgcm:"
+
+var (
+	errNoMasterKey   = errors.New("password is encrypted but auth.master_key is empty")
+	errBadCiphertext = errors.New("encrypted password is malformed or master key is wrong")
+)
+
+// passwordCipher 为nil时不加密。
+// hmac需要原始密码作为密钥，所以只能可逆加密，不能用哈希
+var passwordCipher cipher.AEAD
+
+// initCipher 用master key的SHA-256作为AES-256的密钥
+func initCipher(masterKey string) error {
+	if masterKey == "" {
+		passwordCipher = nil
+		return nil
+	}
+	key := sha256.Sum256([]byte(masterKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	passwordCipher, err = cipher.NewGCM(block)
+	return err
+}
+
+func isEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, encryptedPrefix)
+}
+
+// encryptPassword username作为附加数据，防止把密文复制到其他用户的记录上
+func encryptPassword(username string, password string) (string, error) {
+	if passwordCipher == nil {
+		return password, nil
+	}
+	nonce := make([]byte, passwordCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := passwordCipher.Seal(nonce, nonce, []byte(password), []byte(username))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptPassword(username string, stored string) (string, error) {
+	if !isEncrypted(stored) {
+		return stored, nil
+	}
+	if passwordCipher == nil {
+		return "", errNoMasterKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored[len(encryptedPrefix):])
+	if err != nil || len(sealed) < passwordCipher.NonceSize() {
+		return "", errBadCiphertext
+	}
+	nonceSize := passwordCipher.NonceSize()
+	plain, err := passwordCipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(username))
+	if err != nil {
+		return "", errBadCiphertext
+	}
+	return string(plain), nil
+}
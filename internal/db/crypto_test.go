@@ -0,0 +1,109 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func useMasterKey(t *testing.T, masterKey string) {
+	t.Helper()
+	if err := initCipher(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { initCipher("") })
+}
+
+func TestPasswordRoundTrip(t *testing.T) {
+	useMasterKey(t, "master")
+	stored, err := encryptPassword("user1", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(stored) {
+		t.Fatalf("stored password %q not encrypted", stored)
+	}
+	again, _ := encryptPassword("user1", "password1")
+	if again == stored {
+		t.Fatal("nonce reused for the same password")
+	}
+	password, err := decryptPassword("user1", stored)
+	if err != nil || password != "password1" {
+		t.Fatalf("decryptPassword = %q, %v", password, err)
+	}
+}
+
+func TestPasswordDecryptErrors(t *testing.T) {
+	useMasterKey(t, "master")
+	stored, _ := encryptPassword("user1", "password1")
+	sealed, _ := base64.StdEncoding.DecodeString(stored[len(encryptedPrefix):])
+	sealed[len(sealed)-1] ^= 0x01
+	tampered := encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	tests := []struct {
+		name     string
+		username string
+		stored   string
+	}{
+		// 用户名是附加数据，复制到其他用户的记录上无法解密
+		{"other username", "user2", stored},
+		{"tampered", "user1", tampered},
+		{"bad base64", "user1", encryptedPrefix + "!!!"},
+		{"too short", "user1", encryptedPrefix + base64.StdEncoding.EncodeToString([]byte("abc"))},
+	}
+	for _, tt := range tests {
+		if _, err := decryptPassword(tt.username, tt.stored); !errors.Is(err, errBadCiphertext) {
+			t.Errorf("%s: err = %v, want errBadCiphertext", tt.name, err)
+		}
+	}
+	useMasterKey(t, "other")
+	if _, err := decryptPassword("user1", stored); !errors.Is(err, errBadCiphertext) {
+		t.Errorf("wrong master key: err = %v, want errBadCiphertext", err)
+	}
+	useMasterKey(t, "")
+	if _, err := decryptPassword("user1", stored); !errors.Is(err, errNoMasterKey) {
+		t.Errorf("no master key: err = %v, want errNoMasterKey", err)
+	}
+}
+
+// 没有配置master key时原样保存，旧版本的明文密码原样读出
+func TestPasswordPlaintext(t *testing.T) {
+	useMasterKey(t, "")
+	stored, err := encryptPassword("user1", "password1")
+	if err != nil || stored != "password1" {
+		t.Fatalf("encryptPassword = %q, %v", stored, err)
+	}
+	useMasterKey(t, "master")
+	if password, err := decryptPassword("user1", "password1"); err != nil || password != "password1" {
+		t.Fatalf("decryptPassword(plaintext) = %q, %v", password, err)
+	}
+}
@@ -44,11 +44,14 @@ var dbConn *gorm.DB
 // 结构体'User'默认对应数据库表'users'
 type User struct {
 	gorm.Model
-	Username string
-	Password string
+	Username  string
+	Password  string // 配置了auth.master_key时加密保存，QueryByUserName返回解密后的密码
+	ReqToResp uint32 // 用户级别限速，单位kbps，0表示使用全局配置
+	RespToReq uint32
 }
 
-func init() {
+// Init 打开配置中的数据库，需要在conf.Init之后调用
+func Init() {
 	if !conf.Xml.Auth.UseDB {
 		return
 	}
@@ -58,15 +61,70 @@ func init() {
 	}
 	db.AutoMigrate(&User{})
 	dbConn = db
+	if err := initCipher(conf.Xml.Auth.MasterKey); err != nil {
+		panic(fmt.Sprintf("Failed to init password cipher: %v", err))
+	}
+	if passwordCipher == nil {
+		logrus.Warn("auth.master_key is empty, passwords in database are stored in plaintext")
+	}
+	if err := migratePasswords(); err != nil {
+		panic(fmt.Sprintf("Failed to migrate passwords in database(%s): %v", conf.Xml.Auth.DB, err))
+	}
+}
+
+// migratePasswords 配置了master key后，把旧版本保存的明文密码加密。
+// 没有配置master key时，检查是否已经有加密的密码，避免之后所有验证都失败
+func migratePasswords() error {
+	var users []User
+	result := dbConn.Find(&users)
+	if result.Error != nil {
+		return result.Error
+	}
+	migrated := 0
+	for i := range users {
+		user := &users[i]
+		if isEncrypted(user.Password) {
+			if _, err := decryptPassword(user.Username, user.Password); err != nil {
+				return fmt.Errorf("user %s: %w", user.Username, err)
+			}
+			continue
+		}
+		if passwordCipher == nil {
+			continue
+		}
+		encrypted, err := encryptPassword(user.Username, user.Password)
+		if err != nil {
+			return err
+		}
+		if result := dbConn.Model(user).Update("password", encrypted); result.Error != nil {
+			return result.Error
+		}
+		migrated++
+	}
+	if migrated != 0 {
+		logrus.Infof("Encrypted %d plaintext passwords in table 'users'", migrated)
+	}
+	return nil
 }
 
+// QueryByUserName 用户名为空时直接返回gorm.ErrRecordNotFound。
+// 不能使用结构体作为查询条件，gorm会忽略其中的零值字段，空用户名将查到第一条记录
 func QueryByUserName(username string) (*User, error) {
-	user := User{Username: username}
-	result := dbConn.First(&user)
+	if username == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var user User
+	result := dbConn.Where("username = ?", username).First(&user)
 	if result.Error != nil {
 		logrus.Errorf("Select table 'users' with {username:'%s'} failed with: %v", username, result.Error)
 		return nil, result.Error
 	}
+	password, err := decryptPassword(user.Username, user.Password)
+	if err != nil {
+		logrus.Errorf("Decrypt password of user '%s' failed with: %v", username, err)
+		return nil, err
+	}
+	user.Password = password
 	return &user, nil
 }
 
@@ -78,13 +136,22 @@ func QueryUserList(index int) ([]User, error) {
 		logrus.Errorf("Query table 'users' with limit(%d) offset(%d) failed with: %v", kLimit, index, result.Error)
 		return nil, result.Error
 	}
+	// 列表只用于展示，不返回密码
+	for i := range users {
+		users[i].Password = ""
+	}
 	return users, nil
 }
 
 func AddUser(username string, password string) error {
+	encrypted, err := encryptPassword(username, password)
+	if err != nil {
+		logrus.Errorf("Encrypt password of user '%s' failed with: %v", username, err)
+		return err
+	}
 	user := User{
 		Username: username,
-		Password: password,
+		Password: encrypted,
 	}
 	result := dbConn.Create(&user)
 	if result.Error != nil {
@@ -0,0 +1,89 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package db
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// useTestDB 使用内存数据库代替配置中的数据库
+func useTestDB(t *testing.T) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	old := dbConn
+	dbConn = db
+	t.Cleanup(func() { dbConn = old })
+}
+
+func TestQueryByUserName(t *testing.T) {
+	useTestDB(t)
+	for _, username := range []string{"user1", "user2"} {
+		if err := AddUser(username, "password-"+username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		username string
+		found    bool
+	}{
+		{"user1", true},
+		{"user2", true},
+		{"user3", false},
+		// 结构体条件会忽略空用户名，查到第一条记录
+		{"", false},
+	}
+	for _, tt := range tests {
+		user, err := QueryByUserName(tt.username)
+		if !tt.found {
+			if err == nil {
+				t.Errorf("QueryByUserName(%q) returned user %q", tt.username, user.Username)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("QueryByUserName(%q): %v", tt.username, err)
+			continue
+		}
+		if user.Username != tt.username || user.Password != "password-"+tt.username {
+			t.Errorf("QueryByUserName(%q) = %q/%q", tt.username, user.Username, user.Password)
+		}
+	}
+}
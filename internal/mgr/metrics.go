@@ -0,0 +1,178 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mgr
+
+import (
+	"relay/internal/msg"
+	"relay/internal/session"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	roomsDesc = prometheus.NewDesc("relay_rooms",
+		"Number of active rooms.", nil, nil)
+	halfOpenRoomsDesc = prometheus.NewDesc("relay_rooms_half_open",
+		"Number of rooms created but not joined yet.", nil, nil)
+	roomsCreatedDesc = prometheus.NewDesc("relay_rooms_created_total",
+		"Total number of rooms created.", nil, nil)
+	roomsRemovedDesc = prometheus.NewDesc("relay_rooms_removed_total",
+		"Total number of rooms removed, by reason.", []string{"reason"}, nil)
+	sweepsDesc = prometheus.NewDesc("relay_cleanup_sweeps_total",
+		"Total number of idle session cleanup sweeps.", nil, nil)
+	rebindsDesc = prometheus.NewDesc("relay_rebinds_total",
+		"Total number of peers migrated to a new address by rebind requests.", nil, nil)
+	bansDesc = prometheus.NewDesc("relay_bans_total",
+		"Total number of times a source IP or username was banned for too many auth failures.", nil, nil)
+	bannedRequestsDesc = prometheus.NewDesc("relay_banned_requests_total",
+		"Total number of requests dropped because the source IP or username was banned.", nil, nil)
+	rateLimitedControlDesc = prometheus.NewDesc("relay_control_rate_limited_total",
+		"Total number of control messages dropped by rate limit, by scope.", []string{"scope"}, nil)
+	deniedPacketsDesc = prometheus.NewDesc("relay_denied_packets_total",
+		"Total number of packets dropped because the source address was not allowed by the net acl.", nil, nil)
+	activeBansDesc = prometheus.NewDesc("relay_bans_active",
+		"Number of bans in effect, by kind.", []string{"kind"}, nil)
+	packetsDesc = prometheus.NewDesc("relay_relayed_packets_total",
+		"Total number of packets relayed, by direction.", []string{"direction"}, nil)
+	bytesDesc = prometheus.NewDesc("relay_relayed_bytes_total",
+		"Total number of bytes relayed, by direction.", []string{"direction"}, nil)
+	droppedPacketsDesc = prometheus.NewDesc("relay_dropped_packets_total",
+		"Total number of packets dropped by rate limit, by direction.", []string{"direction"}, nil)
+	droppedBytesDesc = prometheus.NewDesc("relay_dropped_bytes_total",
+		"Total number of bytes dropped by rate limit, by direction.", []string{"direction"}, nil)
+	controlMessagesDesc = prometheus.NewDesc("relay_control_messages_total",
+		"Total number of control messages received, by type.", []string{"type"}, nil)
+	unknownPacketsDesc = prometheus.NewDesc("relay_unknown_packets_total",
+		"Total number of packets neither control messages nor belonging to any room.", nil, nil)
+	invalidPacketsDesc = prometheus.NewDesc("relay_invalid_packets_total",
+		"Total number of control messages failed to parse.", nil, nil)
+	authFailuresDesc = prometheus.NewDesc("relay_auth_failures_total",
+		"Total number of rejected create/join requests, by error code.", []string{"code"}, nil)
+	sessionDurationDesc = prometheus.NewDesc("relay_session_duration_seconds",
+		"Duration of finished sessions.", nil, nil)
+)
+
+var msgTypeNames = map[uint32]string{
+	msg.TypeCreateRoomRequest: "create_room",
+	msg.TypeJoinRoomRequest:   "join_room",
+	msg.TypeLeaveRoomRequest:  "leave_room",
+	msg.TypeRebindRequest:     "rebind",
+	msg.TypeKeepaliveRequest:  "keepalive",
+	msg.TypeKeepaliveResponse: "keepalive_response",
+	msg.TypeReflexRequest:     "reflex",
+}
+
+var errCodeNames = map[int32]string{
+	msg.Err_AuthFailed:     "auth_failed",
+	msg.Err_AddressInvalid: "address_invalid",
+	msg.Err_TimeInvalid:    "time_invalid",
+	msg.Err_RoomInvalid:    "room_invalid",
+	msg.Err_Unavailable:    "unavailable",
+}
+
+// relayCollector 在每次抓取时从SessionManager读取计数，不在收包路径上额外加锁
+type relayCollector struct {
+	sessionMgr *session.SessionManager
+}
+
+func (c *relayCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *relayCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.sessionMgr.Stats().Snapshot()
+	rooms, halfOpen := c.sessionMgr.RoomCounts()
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(rooms))
+	ch <- prometheus.MustNewConstMetric(halfOpenRoomsDesc, prometheus.GaugeValue, float64(halfOpen))
+	ch <- prometheus.MustNewConstMetric(roomsCreatedDesc, prometheus.CounterValue, float64(stats.RoomsCreated))
+	ch <- prometheus.MustNewConstMetric(roomsRemovedDesc, prometheus.CounterValue, float64(stats.RoomsExpired), "expired")
+	ch <- prometheus.MustNewConstMetric(roomsRemovedDesc, prometheus.CounterValue, float64(stats.RoomsClosed), "closed")
+	ch <- prometheus.MustNewConstMetric(roomsRemovedDesc, prometheus.CounterValue, float64(stats.RoomsLeft), "left")
+	ch <- prometheus.MustNewConstMetric(sweepsDesc, prometheus.CounterValue, float64(stats.Sweeps))
+	ch <- prometheus.MustNewConstMetric(rebindsDesc, prometheus.CounterValue, float64(stats.Rebinds))
+	ch <- prometheus.MustNewConstMetric(bansDesc, prometheus.CounterValue, float64(stats.Bans))
+	ch <- prometheus.MustNewConstMetric(bannedRequestsDesc, prometheus.CounterValue, float64(stats.BannedRequests))
+	ch <- prometheus.MustNewConstMetric(rateLimitedControlDesc, prometheus.CounterValue, float64(stats.IPLimited), "ip")
+	ch <- prometheus.MustNewConstMetric(rateLimitedControlDesc, prometheus.CounterValue, float64(stats.GlobalLimited), "global")
+	ch <- prometheus.MustNewConstMetric(deniedPacketsDesc, prometheus.CounterValue, float64(stats.DeniedPackets))
+	activeBans := map[string]int{session.BanKindIP: 0, session.BanKindUser: 0}
+	for _, ban := range c.sessionMgr.Bans() {
+		activeBans[ban.Kind]++
+	}
+	for kind, count := range activeBans {
+		ch <- prometheus.MustNewConstMetric(activeBansDesc, prometheus.GaugeValue, float64(count), kind)
+	}
+	for direction, traffic := range map[string]session.TrafficStats{"req_to_resp": stats.ReqToResp, "resp_to_req": stats.RespToReq} {
+		ch <- prometheus.MustNewConstMetric(packetsDesc, prometheus.CounterValue, float64(traffic.Packets), direction)
+		ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue, float64(traffic.Bytes), direction)
+		ch <- prometheus.MustNewConstMetric(droppedPacketsDesc, prometheus.CounterValue, float64(traffic.DroppedPackets), direction)
+		ch <- prometheus.MustNewConstMetric(droppedBytesDesc, prometheus.CounterValue, float64(traffic.DroppedBytes), direction)
+	}
+	for msgType, count := range stats.ControlPackets {
+		name, exists := msgTypeNames[msgType]
+		if !exists {
+			name = strconv.FormatUint(uint64(msgType), 10)
+		}
+		ch <- prometheus.MustNewConstMetric(controlMessagesDesc, prometheus.CounterValue, float64(count), name)
+	}
+	ch <- prometheus.MustNewConstMetric(unknownPacketsDesc, prometheus.CounterValue, float64(stats.UnknownPackets))
+	ch <- prometheus.MustNewConstMetric(invalidPacketsDesc, prometheus.CounterValue, float64(stats.InvalidPackets))
+	for errCode, count := range stats.AuthFailuresByCode {
+		name, exists := errCodeNames[errCode]
+		if !exists {
+			name = strconv.Itoa(int(errCode))
+		}
+		ch <- prometheus.MustNewConstMetric(authFailuresDesc, prometheus.CounterValue, float64(count), name)
+	}
+	// prometheus的直方图桶是累积值
+	buckets := make(map[float64]uint64, len(session.DurationBuckets))
+	var cumulative uint64
+	for i, upper := range session.DurationBuckets {
+		cumulative += stats.SessionDuration.Counts[i]
+		buckets[upper] = cumulative
+	}
+	cumulative += stats.SessionDuration.Counts[len(session.DurationBuckets)]
+	ch <- prometheus.MustNewConstHistogram(sessionDurationDesc, cumulative, stats.SessionDuration.Sum.Seconds(), buckets)
+}
+
+func newMetricsHandler(sessionMgr *session.SessionManager) gin.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		&relayCollector{sessionMgr: sessionMgr},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
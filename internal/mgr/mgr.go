@@ -34,15 +34,21 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
+	"relay/internal/acl"
 	"relay/internal/common"
 	"relay/internal/conf"
 	"relay/internal/db"
+	"relay/internal/msg"
+	"relay/internal/session"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -53,22 +59,91 @@ type responseStruct struct {
 }
 
 type sessionInfo struct {
-	ReqIP     string `json:"req_ip"`
-	ReqPort   uint16 `json:"req_port"`
-	RespIP    string `json:"resp_ip"`
-	RespPort  uint16 `json:"resp_port"`
-	ReqToResp uint32 `json:"req_to_resp"`
-	RespToReq uint32 `json:"resp_to_req"`
-	StartTime int64  `json:"start"`
+	Room       string `json:"room"`
+	Username   string `json:"username"`
+	ReqIP      string `json:"req_ip"`
+	ReqPort    uint16 `json:"req_port"`
+	RespIP     string `json:"resp_ip"`
+	RespPort   uint16 `json:"resp_port"`
+	ReqToResp  uint64 `json:"req_to_resp"`
+	RespToReq  uint64 `json:"resp_to_req"`
+	StartTime  int64  `json:"start"`
+	LastActive int64  `json:"last_active"`
+	ReqRTT     int64  `json:"req_rtt"` // 毫秒，0表示未知
+	RespRTT    int64  `json:"resp_rtt"`
+}
+
+type trafficInfo struct {
+	Packets        uint64 `json:"packets"`
+	Bytes          uint64 `json:"bytes"`
+	DroppedPackets uint64 `json:"dropped_packets"`
+	DroppedBytes   uint64 `json:"dropped_bytes"`
+}
+
+type statTotalData struct {
+	Rooms          int         `json:"rooms"`
+	RoomsCreated   uint64      `json:"rooms_created"`
+	RoomsRemoved   uint64      `json:"rooms_removed"`
+	ReqToResp      trafficInfo `json:"req_to_resp"`
+	RespToReq      trafficInfo `json:"resp_to_req"`
+	CreateRoom     uint64      `json:"create_room"`
+	JoinRoom       uint64      `json:"join_room"`
+	LeaveRoom      uint64      `json:"leave_room"`
+	Rebind         uint64      `json:"rebind"`
+	Keepalive      uint64      `json:"keepalive"`
+	Reflex         uint64      `json:"reflex"`
+	UnknownPackets uint64      `json:"unknown_packets"`
+	InvalidPackets uint64      `json:"invalid_packets"`
+	AuthFailures   uint64      `json:"auth_failures"`
+	Bans           uint64      `json:"bans"`
+	BannedRequests uint64      `json:"banned_requests"`
+	IPLimited      uint64      `json:"ip_limited"`
+	GlobalLimited  uint64      `json:"global_limited"`
+	DeniedPackets  uint64      `json:"denied_packets"`
 }
 
 type statSessionData struct {
 	Sessions []sessionInfo `json:"sessions"`
 }
 
+type connCloseData struct {
+	Closed int `json:"closed"`
+}
+
+type banInfo struct {
+	Kind  string `json:"kind"` // ip或user
+	Key   string `json:"key"`
+	Until int64  `json:"until"`
+	Bans  int    `json:"bans"`
+}
+
+type banListData struct {
+	Bans []banInfo `json:"bans"`
+}
+
+type banLiftData struct {
+	Lifted int `json:"lifted"`
+}
+
+type aclRules struct {
+	Username string   `json:"username,omitempty"`
+	Allow    []string `json:"allow"`
+	Deny     []string `json:"deny"`
+}
+
+type aclListData struct {
+	Net   aclRules   `json:"net"`
+	Users []aclRules `json:"users"`
+}
+
+type aclDelData struct {
+	Removed int `json:"removed"`
+}
+
+// userInfo Password只在添加用户时返回一次，之后无法通过接口查询
 type userInfo struct {
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Password string `json:"password,omitempty"`
 }
 
 type userListData struct {
@@ -79,6 +154,7 @@ type Server struct {
 	router     *gin.Engine
 	stopedChan chan struct{}
 	httpSvr    *http.Server
+	sessionMgr *session.SessionManager
 }
 
 func init() {
@@ -95,11 +171,12 @@ func toGinMode(mode string) string {
 	}
 }
 
-func New() *Server {
+func New(sessionMgr *session.SessionManager) *Server {
 	gin.SetMode(toGinMode(conf.Xml.Mgr.Mode))
 	return &Server{
 		router:     gin.Default(),
 		stopedChan: make(chan struct{}, 2),
+		sessionMgr: sessionMgr,
 	}
 }
 
@@ -109,8 +186,15 @@ func (svr *Server) Start() {
 	svr.router.POST("/user/add", svr.userAdd)
 	svr.router.POST("/user/list", svr.userList)
 	svr.router.POST("/user/del", svr.userDel)
-	// svr.router.POST("/stat/total", svr.statTotal)
-	// svr.router.POST("/stat/conns", svr.statSessions)
+	svr.router.POST("/stat/total", svr.statTotal)
+	svr.router.POST("/stat/conns", svr.statSessions)
+	svr.router.POST("/conn/close", svr.connClose)
+	svr.router.POST("/ban/list", svr.banList)
+	svr.router.POST("/ban/lift", svr.banLift)
+	svr.router.POST("/acl/list", svr.aclList)
+	svr.router.POST("/acl/add", svr.aclAdd)
+	svr.router.POST("/acl/del", svr.aclDel)
+	svr.router.GET("/metrics", newMetricsHandler(svr.sessionMgr))
 	svr.httpSvr = &http.Server{
 		Addr:    conf.Xml.Mgr.ListenIP + ":" + fmt.Sprint(conf.Xml.Mgr.ListenPort),
 		Handler: svr.router,
@@ -143,7 +227,7 @@ func (svr *Server) users(ctx *gin.Context) {
 }
 
 func (svr *Server) stats(ctx *gin.Context) {
-	ctx.String(200, "stats")
+	svr.statTotal(ctx)
 }
 
 func (svr *Server) userAdd(ctx *gin.Context) {
@@ -196,7 +280,6 @@ func (svr *Server) userList(ctx *gin.Context) {
 	for i := 0; i < len(users); i++ {
 		userData.Users = append(userData.Users, userInfo{
 			Username: users[i].Username,
-			Password: users[i].Password,
 		})
 	}
 	ctx.JSON(http.StatusOK, responseStruct{
@@ -227,10 +310,260 @@ func (svr *Server) userDel(ctx *gin.Context) {
 	})
 }
 
-// func (svr *Server) statTotal(ctx *gin.Context) {
+func (svr *Server) statTotal(ctx *gin.Context) {
+	stats := svr.sessionMgr.Stats().Snapshot()
+	data := statTotalData{
+		Rooms:          int(stats.RoomsCreated - stats.RoomsRemoved),
+		RoomsCreated:   stats.RoomsCreated,
+		RoomsRemoved:   stats.RoomsRemoved,
+		ReqToResp:      toTrafficInfo(stats.ReqToResp),
+		RespToReq:      toTrafficInfo(stats.RespToReq),
+		CreateRoom:     stats.ControlPackets[msg.TypeCreateRoomRequest],
+		JoinRoom:       stats.ControlPackets[msg.TypeJoinRoomRequest],
+		LeaveRoom:      stats.ControlPackets[msg.TypeLeaveRoomRequest],
+		Rebind:         stats.ControlPackets[msg.TypeRebindRequest],
+		Keepalive:      stats.ControlPackets[msg.TypeKeepaliveRequest],
+		Reflex:         stats.ControlPackets[msg.TypeReflexRequest],
+		UnknownPackets: stats.UnknownPackets,
+		InvalidPackets: stats.InvalidPackets,
+		AuthFailures:   stats.AuthFailures,
+		Bans:           stats.Bans,
+		BannedRequests: stats.BannedRequests,
+		IPLimited:      stats.IPLimited,
+		GlobalLimited:  stats.GlobalLimited,
+		DeniedPackets:  stats.DeniedPackets,
+	}
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+		Data:   data,
+	})
+}
+
+func (svr *Server) statSessions(ctx *gin.Context) {
+	var data statSessionData
+	data.Sessions = []sessionInfo{}
+	for _, s := range svr.sessionMgr.Sessions() {
+		info := sessionInfo{
+			Room:       s.Room.String(),
+			Username:   s.Username,
+			ReqIP:      s.FirstAddr.IP.String(),
+			ReqPort:    uint16(s.FirstAddr.Port),
+			ReqToResp:  s.ReqToResp.Bytes,
+			RespToReq:  s.RespToReq.Bytes,
+			StartTime:  s.StartTime.Unix(),
+			LastActive: s.LastActiveTime.Unix(),
+			ReqRTT:     s.FirstRTT.Milliseconds(),
+			RespRTT:    s.SecondRTT.Milliseconds(),
+		}
+		if s.SecondAddr != nil {
+			info.RespIP = s.SecondAddr.IP.String()
+			info.RespPort = uint16(s.SecondAddr.Port)
+		}
+		data.Sessions = append(data.Sessions, info)
+	}
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+		Data:   data,
+	})
+}
+
+// connClose 按room、addr或username关闭relay连接，三者任选其一。
+// 按username关闭该用户创建或加入的room，可以用block(秒)禁止该用户在一段时间内重新创建或加入room
+func (svr *Server) connClose(ctx *gin.Context) {
+	room := ctx.PostForm("room")
+	addr := ctx.PostForm("addr")
+	username := ctx.PostForm("username")
+	var data connCloseData
+	switch {
+	case room != "":
+		roomUUID, err := uuid.Parse(room)
+		if err != nil {
+			ctx.JSON(http.StatusOK, responseStruct{
+				Status:  2,
+				Message: "Invalid parameter",
+			})
+			return
+		}
+		if svr.sessionMgr.CloseRoom(roomUUID) {
+			data.Closed = 1
+		}
+	case addr != "":
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			ctx.JSON(http.StatusOK, responseStruct{
+				Status:  2,
+				Message: "Invalid parameter",
+			})
+			return
+		}
+		if svr.sessionMgr.CloseAddr(udpAddr) {
+			data.Closed = 1
+		}
+	case username != "":
+		block := 0
+		if ctx.PostForm("block") != "" {
+			var err error
+			block, err = strconv.Atoi(ctx.PostForm("block"))
+			if err != nil || block < 0 {
+				ctx.JSON(http.StatusOK, responseStruct{
+					Status:  2,
+					Message: "Invalid parameter",
+				})
+				return
+			}
+		}
+		data.Closed = svr.sessionMgr.CloseUser(username, time.Duration(block)*time.Second)
+	default:
+		ctx.JSON(http.StatusOK, responseStruct{
+			Status:  2,
+			Message: "Invalid parameter",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+		Data:   data,
+	})
+}
+
+func (svr *Server) banList(ctx *gin.Context) {
+	var data banListData
+	data.Bans = []banInfo{}
+	for _, ban := range svr.sessionMgr.Bans() {
+		data.Bans = append(data.Bans, banInfo{
+			Kind:  ban.Kind,
+			Key:   ban.Key,
+			Until: ban.Until.Unix(),
+			Bans:  ban.Bans,
+		})
+	}
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+		Data:   data,
+	})
+}
+
+// banLift 按ip或username解除封禁，二者任选其一
+func (svr *Server) banLift(ctx *gin.Context) {
+	ip := ctx.PostForm("ip")
+	username := ctx.PostForm("username")
+	var data banLiftData
+	switch {
+	case ip != "":
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			ctx.JSON(http.StatusOK, responseStruct{
+				Status:  2,
+				Message: "Invalid parameter",
+			})
+			return
+		}
+		if svr.sessionMgr.LiftIPBan(parsed) {
+			data.Lifted = 1
+		}
+	case username != "":
+		if svr.sessionMgr.LiftUserBan(username) {
+			data.Lifted = 1
+		}
+	default:
+		ctx.JSON(http.StatusOK, responseStruct{
+			Status:  2,
+			Message: "Invalid parameter",
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+		Data:   data,
+	})
+}
+
+func (svr *Server) aclList(ctx *gin.Context) {
+	data := aclListData{
+		Net:   toACLRules("", svr.sessionMgr.NetACL().Rules()),
+		Users: []aclRules{},
+	}
+	for username, rules := range svr.sessionMgr.UserACLs() {
+		data.Users = append(data.Users, toACLRules(username, rules))
+	}
+	sort.Slice(data.Users, func(i, j int) bool {
+		return data.Users[i].Username < data.Users[j].Username
+	})
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+		Data:   data,
+	})
+}
+
+// aclAdd 向全局或username的网段列表添加一个网段，kind为allow或deny。
+// 修改只保存在内存中，配置文件中的列表变化后重新加载会覆盖
+func (svr *Server) aclAdd(ctx *gin.Context) {
+	var list *acl.List
+	if username := ctx.PostForm("username"); username != "" {
+		list = svr.sessionMgr.UserACL(username, true)
+	} else {
+		list = svr.sessionMgr.NetACL()
+	}
+	if err := list.Add(ctx.PostForm("kind"), ctx.PostForm("cidr")); err != nil {
+		ctx.JSON(http.StatusOK, responseStruct{
+			Status:  2,
+			Message: "Invalid parameter",
+		})
+		return
+	}
+	logrus.Infof("Added %s %s to %s", ctx.PostForm("kind"), ctx.PostForm("cidr"), aclName(ctx.PostForm("username")))
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+	})
+}
+
+// aclDel 从全局或username的网段列表删除一个网段，参数与aclAdd相同
+func (svr *Server) aclDel(ctx *gin.Context) {
+	list := svr.sessionMgr.NetACL()
+	if username := ctx.PostForm("username"); username != "" {
+		list = svr.sessionMgr.UserACL(username, false)
+	}
+	var data aclDelData
+	if list != nil {
+		removed, err := list.Remove(ctx.PostForm("kind"), ctx.PostForm("cidr"))
+		if err != nil {
+			ctx.JSON(http.StatusOK, responseStruct{
+				Status:  2,
+				Message: "Invalid parameter",
+			})
+			return
+		}
+		if removed {
+			logrus.Infof("Removed %s %s from %s", ctx.PostForm("kind"), ctx.PostForm("cidr"), aclName(ctx.PostForm("username")))
+			data.Removed = 1
+		}
+	}
+	ctx.JSON(http.StatusOK, responseStruct{
+		Status: 0,
+		Data:   data,
+	})
+}
 
-// }
+func aclName(username string) string {
+	if username == "" {
+		return "net acl"
+	}
+	return "acl of user " + username
+}
 
-// func (svr *Server) statSessions(ctx *gin.Context) {
+func toACLRules(username string, rules acl.Rules) aclRules {
+	return aclRules{
+		Username: username,
+		Allow:    rules.Allow,
+		Deny:     rules.Deny,
+	}
+}
 
-// }
+func toTrafficInfo(stats session.TrafficStats) trafficInfo {
+	return trafficInfo{
+		Packets:        stats.Packets,
+		Bytes:          stats.Bytes,
+		DroppedPackets: stats.DroppedPackets,
+		DroppedBytes:   stats.DroppedBytes,
+	}
+}
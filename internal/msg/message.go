@@ -32,6 +32,8 @@ package msg
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
 	"encoding/binary"
 	"net"
 	"relay/internal/common"
@@ -47,8 +49,14 @@ const (
 	TypeCreateRoomResponse uint32 = 0x123002
 	TypeJoinRoomRequest    uint32 = 0x123003
 	TypeJoinRoomResponse   uint32 = 0x123004
+	TypeLeaveRoomRequest   uint32 = 0x123005
+	TypeLeaveRoomResponse  uint32 = 0x123006
+	TypeRebindRequest      uint32 = 0x123007
+	TypeRebindResponse     uint32 = 0x123008
 	TypeReflexRequest      uint32 = 0x124001
 	TypeReflexResponse     uint32 = 0x124002
+	TypeKeepaliveRequest   uint32 = 0x125001
+	TypeKeepaliveResponse  uint32 = 0x125002
 )
 
 const (
@@ -56,20 +64,31 @@ const (
 	Err_AuthFailed     int32 = 1
 	Err_AddressInvalid int32 = 2
 	Err_TimeInvalid    int32 = 3
+	Err_RoomInvalid    int32 = 4
+	Err_Unavailable    int32 = 5 // 服务器正在关闭，不再创建新的room
 )
 
 const (
-	MsgMagic   uint32 = 0x847292df
-	VersionTwo uint32 = 2
+	MsgMagic     uint32 = 0x847292df
+	VersionTwo   uint32 = 2
+	VersionThree uint32 = 3 // 地址扩展为16字节，支持IPv6
 )
 
+// VersionThree中Family字段的取值
 const (
-	FieldsUsedSize  = 4*6 + 8 /*Time*/ + common.Fixed16*4 + common.Fixed20 /*Integrity*/
-	IntegritySize   = common.Fixed20
-	BaseMessageSize = 256
+	FamilyIPv4 uint32 = 4
+	FamilyIPv6 uint32 = 6
+)
+
+const (
+	FieldsUsedSize   = 4*6 + 8 /*Time*/ + common.Fixed16*4 + common.Fixed20 /*Integrity*/
+	FieldsUsedSizeV3 = 4*6 + 8 /*Time*/ + common.Fixed16*5 + common.Fixed20 /*Integrity*/
+	IntegritySize    = common.Fixed20
+	BaseMessageSize  = 256
 )
 
 // 暂时简化，实际布局共用一个结构体，有些消息没用到的字段就忽略
+// VersionTwo的布局，IP只有4字节，仅支持IPv4
 type baseMessage struct {
 	Magic     uint32               // 4
 	Version   uint32               // 4
@@ -86,39 +105,135 @@ type baseMessage struct {
 	Integrity [common.Fixed20]byte // 20
 }
 
+// VersionThree的布局，IP扩展为16字节，由Family区分IPv4与IPv6。
+// Family为FamilyIPv4时只使用IP的前4字节
+type baseMessageV3 struct {
+	Magic     uint32               // 4
+	Version   uint32               // 4
+	Type      uint32               // 4
+	Errcode   int32                // 4
+	Time      int64                // 8
+	Family    uint32               // 4
+	Port      uint32               // 4
+	IP        [common.Fixed16]byte // 16
+	Token     [common.Fixed16]byte // 16
+	ID        [common.Fixed16]byte // 16
+	Username  [common.Fixed16]byte // 16
+	Room      [common.Fixed16]byte // 16
+	Padding   [BaseMessageSize - FieldsUsedSizeV3]byte
+	Integrity [common.Fixed20]byte // 20
+}
+
 type CreateRoomRequest struct {
+	Version   uint32
 	ID        string
 	Username  string
 	Time      time.Time
-	IP        uint32
+	IP        net.IP
 	Port      uint32
 	Token     string
 	Integrity string
 }
 
+// CreateRoomResponse Token是relay给这一方分配的session token，NAT映射变化后用来RebindRequest。
+// VersionTwo的客户端不支持rebind，Token为空
 type CreateRoomResponse struct {
+	Version uint32
 	ID      string
 	ErrCode int32
 	Room    uuid.UUID
+	Token   string
 }
 
 type JoinRoomRequest struct {
+	Version   uint32
 	ID        string
 	Username  string
 	Time      time.Time
+	IP        net.IP
+	Port      uint32
+	Token     string
 	Room      uuid.UUID
 	Integrity string
 }
 
 type JoinRoomResponse struct {
+	Version uint32
+	ID      string
+	ErrCode int32
+	Room    uuid.UUID
+	Token   string
+}
+
+type LeaveRoomRequest struct {
+	Version   uint32
+	ID        string
+	Username  string
+	Time      time.Time
+	IP        net.IP
+	Port      uint32
+	Token     string
+	Room      uuid.UUID
+	Integrity string
+}
+
+// LeaveRoomResponse ID全为0时不是回复，而是relay通知另一方room已经关闭
+type LeaveRoomResponse struct {
+	Version uint32
+	ID      string
+	ErrCode int32
+	Room    uuid.UUID
+}
+
+// LeaveNotifyID relay主动通知对端时使用的ID
+var LeaveNotifyID = string(make([]byte, common.Fixed16))
+
+// RebindRequest NAT映射变化后，客户端用新地址发送，把session中自己的地址换成新地址。
+// IP、Port是通过reflex获取的新地址，Token是创建/加入room时relay分配的session token
+type RebindRequest struct {
+	Version   uint32
+	ID        string
+	Username  string
+	Time      time.Time
+	IP        net.IP
+	Port      uint32
+	Token     string
+	Room      uuid.UUID
+	Integrity string
+}
+
+type RebindResponse struct {
+	Version uint32
 	ID      string
 	ErrCode int32
 	Room    uuid.UUID
 }
 
+// KeepaliveRequest 客户端和relay都可以发送，收到的一方原样回复ID和Time。
+// relay发出的探测带有随机ID，按ID查找发送时间计算RTT；客户端发出的请求ID为空，
+// 客户端用带回的Time计算RTT。Time精确到毫秒
+type KeepaliveRequest struct {
+	Version uint32
+	ID      string
+	Room    uuid.UUID
+	Time    time.Time
+}
+
+type KeepaliveResponse struct {
+	Version uint32
+	ID      string
+	Room    uuid.UUID
+	Time    time.Time
+}
+
+type ReflexRequest struct {
+	Version uint32
+}
+
 type ReflexResponse struct {
-	Addr  *net.UDPAddr
-	Token string
+	Version uint32
+	Addr    *net.UDPAddr
+	Token   string
 }
 
 func clen(data []byte) int {
@@ -130,6 +245,118 @@ func clen(data []byte) int {
 	return len(data)
 }
 
+func isSupportedVersion(version uint32) bool {
+	return version == VersionTwo || version == VersionThree
+}
+
+// decode 把VersionTwo或VersionThree的数据统一解析成VersionThree的布局，
+// 长度或Family不合法时返回nil
+func decode(data []byte) *baseMessageV3 {
+	if len(data) != BaseMessageSize {
+		return nil
+	}
+	reader := bytes.NewReader(data)
+	var msg baseMessageV3
+	if binary.LittleEndian.Uint32(data[4:8]) != VersionTwo {
+		binary.Read(reader, binary.LittleEndian, &msg)
+		// Family只有两种取值，其它值的地址无法解释，按格式错误处理
+		if msg.Family != FamilyIPv4 && msg.Family != FamilyIPv6 {
+			return nil
+		}
+		return &msg
+	}
+	var v2 baseMessage
+	binary.Read(reader, binary.LittleEndian, &v2)
+	msg = baseMessageV3{
+		Magic:     v2.Magic,
+		Version:   v2.Version,
+		Type:      v2.Type,
+		Errcode:   v2.Errcode,
+		Time:      v2.Time,
+		Family:    FamilyIPv4,
+		Port:      v2.Port,
+		Token:     v2.Token,
+		ID:        v2.ID,
+		Username:  v2.Username,
+		Room:      v2.Room,
+		Integrity: v2.Integrity,
+	}
+	// VersionTwo的IP以小端uint32存储，还原后即网络字节序
+	binary.LittleEndian.PutUint32(msg.IP[:4], v2.IP)
+	return &msg
+}
+
+// encode 按msg.Version选择布局序列化，VersionTwo无法携带IPv6地址，此时返回nil
+func encode(msg *baseMessageV3) []byte {
+	buffer := bytes.Buffer{}
+	if msg.Version != VersionTwo {
+		binary.Write(&buffer, binary.LittleEndian, msg)
+		return buffer.Bytes()
+	}
+	if msg.Family != FamilyIPv4 {
+		return nil
+	}
+	v2 := baseMessage{
+		Magic:     msg.Magic,
+		Version:   msg.Version,
+		Type:      msg.Type,
+		Errcode:   msg.Errcode,
+		Time:      msg.Time,
+		IP:        binary.LittleEndian.Uint32(msg.IP[:4]),
+		Port:      msg.Port,
+		Token:     msg.Token,
+		ID:        msg.ID,
+		Username:  msg.Username,
+		Room:      msg.Room,
+		Integrity: msg.Integrity,
+	}
+	binary.Write(&buffer, binary.LittleEndian, v2)
+	return buffer.Bytes()
+}
+
+func (m *baseMessageV3) ip() net.IP {
+	if m.Family == FamilyIPv6 {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, m.IP[:])
+		return ip
+	}
+	return net.IPv4(m.IP[0], m.IP[1], m.IP[2], m.IP[3])
+}
+
+func (m *baseMessageV3) setIP(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		m.Family = FamilyIPv4
+		copy(m.IP[:], ip4)
+	} else {
+		m.Family = FamilyIPv6
+		copy(m.IP[:], ip.To16())
+	}
+}
+
+// Integrity 计算消息的hmac，data为完整的消息，Integrity字段本身不参与计算
+func Integrity(data []byte, key string) []byte {
+	h := hmac.New(sha1.New, []byte(key))
+	h.Write(data[:BaseMessageSize-IntegritySize])
+	return h.Sum(nil)
+}
+
+// Sign 把hmac写入消息的Integrity字段。
+// VersionTwo的客户端不校验回复，只有VersionThree及以上的回复需要签名
+func Sign(data []byte, key string) {
+	if len(data) != BaseMessageSize {
+		return
+	}
+	copy(data[BaseMessageSize-IntegritySize:], Integrity(data, key))
+}
+
+// Verify 校验消息的Integrity字段
+func Verify(data []byte, key string) bool {
+	if len(data) != BaseMessageSize {
+		return false
+	}
+	return hmac.Equal(data[BaseMessageSize-IntegritySize:], Integrity(data, key))
+}
+
 type typeHelperSt struct {
 	Magic   uint32
 	Version uint32
@@ -152,14 +379,20 @@ func MessageType(data []byte) uint32 {
 		logrus.Debugf("magic != MsgMagic")
 		return TypeUnknown
 	}
-	if helper.Version != VersionTwo {
-		logrus.Debugf("version != VersionTwo")
+	if !isSupportedVersion(helper.Version) {
+		logrus.Debugf("version(%d) not supported", helper.Version)
 		return TypeUnknown
 	}
 	if helper.Type == TypeCreateRoomRequest ||
 		helper.Type == TypeCreateRoomResponse ||
 		helper.Type == TypeJoinRoomRequest ||
 		helper.Type == TypeJoinRoomResponse ||
+		helper.Type == TypeLeaveRoomRequest ||
+		helper.Type == TypeLeaveRoomResponse ||
+		helper.Type == TypeRebindRequest ||
+		helper.Type == TypeRebindResponse ||
+		helper.Type == TypeKeepaliveRequest ||
+		helper.Type == TypeKeepaliveResponse ||
 		helper.Type == TypeReflexRequest ||
 		helper.Type == TypeReflexResponse {
 		return helper.Type
@@ -185,6 +418,30 @@ func IsJoinRoomResponse(data []byte) bool {
 	return MessageType(data) == TypeJoinRoomResponse
 }
 
+func IsLeaveRoomRequest(data []byte) bool {
+	return MessageType(data) == TypeLeaveRoomRequest
+}
+
+func IsLeaveRoomResponse(data []byte) bool {
+	return MessageType(data) == TypeLeaveRoomResponse
+}
+
+func IsRebindRequest(data []byte) bool {
+	return MessageType(data) == TypeRebindRequest
+}
+
+func IsRebindResponse(data []byte) bool {
+	return MessageType(data) == TypeRebindResponse
+}
+
+func IsKeepaliveRequest(data []byte) bool {
+	return MessageType(data) == TypeKeepaliveRequest
+}
+
+func IsKeepaliveResponse(data []byte) bool {
+	return MessageType(data) == TypeKeepaliveResponse
+}
+
 func IsReflexRequest(data []byte) bool {
 	return MessageType(data) == TypeReflexRequest
 }
@@ -194,17 +451,16 @@ func IsReflexResponse(data []byte) bool {
 }
 
 func ParseCreateRoomRequest(data []byte) *CreateRoomRequest {
-	if len(data) != BaseMessageSize {
+	msg := decode(data)
+	if msg == nil {
 		return nil
 	}
-	reader := bytes.NewReader(data)
-	var msg baseMessage
-	binary.Read(reader, binary.LittleEndian, &msg)
 	request := CreateRoomRequest{
+		Version:   msg.Version,
 		ID:        string(msg.ID[:]),
 		Username:  string(msg.Username[:clen(msg.Username[:])]),
 		Time:      time.Unix(msg.Time, 0),
-		IP:        msg.IP,
+		IP:        msg.ip(),
 		Port:      msg.Port,
 		Token:     string(msg.Token[:]),
 		Integrity: string(msg.Integrity[:]),
@@ -212,32 +468,30 @@ func ParseCreateRoomRequest(data []byte) *CreateRoomRequest {
 	return &request
 }
 
-// func ParseCreateRoomResponse(data []byte) *CreateRoomResponse {
-// 	if len(data) != BaseMessageSize {
-// 		return nil
-// 	}
-// 	reader := bytes.NewReader(data)
-// 	var msg baseMessage
-// 	binary.Read(reader, binary.LittleEndian, &msg)
-// 	room, err := uuid.FromBytes(msg.Room[:])
-// 	if err != nil {
-// 		return nil
-// 	}
-// 	response := CreateRoomResponse{
-// 		ID:      string(msg.ID[:]),
-// 		ErrCode: msg.Errcode,
-// 		Room:    room,
-// 	}
-// 	return &response
-// }
+func ParseCreateRoomResponse(data []byte) *CreateRoomResponse {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	response := CreateRoomResponse{
+		Version: msg.Version,
+		ID:      string(msg.ID[:]),
+		ErrCode: msg.Errcode,
+		Room:    room,
+		Token:   string(msg.Token[:clen(msg.Token[:])]),
+	}
+	return &response
+}
 
 func ParseJoinRoomRequest(data []byte) *JoinRoomRequest {
-	if len(data) != BaseMessageSize {
+	msg := decode(data)
+	if msg == nil {
 		return nil
 	}
-	reader := bytes.NewReader(data)
-	var msg baseMessage
-	binary.Read(reader, binary.LittleEndian, &msg)
 	room, err := uuid.FromBytes(msg.Room[:])
 	if err != nil {
 		return nil
@@ -247,107 +501,461 @@ func ParseJoinRoomRequest(data []byte) *JoinRoomRequest {
 		return nil
 	}
 	request := JoinRoomRequest{
+		Version:   msg.Version,
+		ID:        string(msg.ID[:]),
+		Username:  string(msg.Username[:usernameLen]),
+		Time:      time.Unix(msg.Time, 0),
+		IP:        msg.ip(),
+		Port:      msg.Port,
+		Token:     string(msg.Token[:]),
+		Room:      room,
+		Integrity: string(msg.Integrity[:]),
+	}
+	return &request
+}
+
+func ParseJoinRoomResponse(data []byte) *JoinRoomResponse {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	response := JoinRoomResponse{
+		Version: msg.Version,
+		ID:      string(msg.ID[:]),
+		ErrCode: msg.Errcode,
+		Room:    room,
+		Token:   string(msg.Token[:clen(msg.Token[:])]),
+	}
+	return &response
+}
+
+func ParseLeaveRoomRequest(data []byte) *LeaveRoomRequest {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	usernameLen := clen(msg.Username[:])
+	if usernameLen == 0 {
+		return nil
+	}
+	request := LeaveRoomRequest{
+		Version:   msg.Version,
 		ID:        string(msg.ID[:]),
 		Username:  string(msg.Username[:usernameLen]),
 		Time:      time.Unix(msg.Time, 0),
+		IP:        msg.ip(),
+		Port:      msg.Port,
+		Token:     string(msg.Token[:]),
 		Room:      room,
 		Integrity: string(msg.Integrity[:]),
 	}
 	return &request
 }
 
-// func ParseJoinRoomResponse(data []byte) *JoinRoomResponse {
-// 	if len(data) != BaseMessageSize {
-// 		return nil
-// 	}
-// 	reader := bytes.NewReader(data)
-// 	var msg baseMessage
-// 	binary.Read(reader, binary.LittleEndian, &msg)
-// 	room, err := uuid.FromBytes(msg.Room[:])
-// 	if err != nil {
-// 		return nil
-// 	}
-// 	response := JoinRoomResponse{
-// 		ID:      string(msg.ID[:]),
-// 		ErrCode: msg.Errcode,
-// 		Room:    room,
-// 	}
-// 	return &response
-// }
-
-func NewCreateRoomResponse(ID string, errCode int32, room uuid.UUID) *CreateRoomResponse {
-	// 是否加入校验？
+func ParseLeaveRoomResponse(data []byte) *LeaveRoomResponse {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	response := LeaveRoomResponse{
+		Version: msg.Version,
+		ID:      string(msg.ID[:]),
+		ErrCode: msg.Errcode,
+		Room:    room,
+	}
+	return &response
+}
+
+func ParseRebindRequest(data []byte) *RebindRequest {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	usernameLen := clen(msg.Username[:])
+	if usernameLen == 0 {
+		return nil
+	}
+	request := RebindRequest{
+		Version:   msg.Version,
+		ID:        string(msg.ID[:]),
+		Username:  string(msg.Username[:usernameLen]),
+		Time:      time.Unix(msg.Time, 0),
+		IP:        msg.ip(),
+		Port:      msg.Port,
+		Token:     string(msg.Token[:]),
+		Room:      room,
+		Integrity: string(msg.Integrity[:]),
+	}
+	return &request
+}
+
+func ParseRebindResponse(data []byte) *RebindResponse {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	response := RebindResponse{
+		Version: msg.Version,
+		ID:      string(msg.ID[:]),
+		ErrCode: msg.Errcode,
+		Room:    room,
+	}
+	return &response
+}
+
+func ParseKeepaliveRequest(data []byte) *KeepaliveRequest {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	request := KeepaliveRequest{
+		Version: msg.Version,
+		ID:      string(msg.ID[:]),
+		Room:    room,
+		Time:    time.UnixMilli(msg.Time),
+	}
+	return &request
+}
+
+func ParseKeepaliveResponse(data []byte) *KeepaliveResponse {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	room, err := uuid.FromBytes(msg.Room[:])
+	if err != nil {
+		return nil
+	}
+	response := KeepaliveResponse{
+		Version: msg.Version,
+		ID:      string(msg.ID[:]),
+		Room:    room,
+		Time:    time.UnixMilli(msg.Time),
+	}
+	return &response
+}
+
+func ParseReflexRequest(data []byte) *ReflexRequest {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	return &ReflexRequest{
+		Version: msg.Version,
+	}
+}
+
+func ParseReflexResponse(data []byte) *ReflexResponse {
+	msg := decode(data)
+	if msg == nil {
+		return nil
+	}
+	return &ReflexResponse{
+		Version: msg.Version,
+		Addr:    &net.UDPAddr{IP: msg.ip(), Port: int(msg.Port)},
+		Token:   string(msg.Token[:]),
+	}
+}
+
+// NewCreateRoomResponse VersionThree及以上的回复需要在ToBytes之后调用Sign
+func NewCreateRoomResponse(version uint32, ID string, errCode int32, room uuid.UUID, token string) *CreateRoomResponse {
 	return &CreateRoomResponse{
+		Version: version,
 		ID:      ID,
 		ErrCode: errCode,
 		Room:    room,
+		Token:   token,
 	}
 }
 
-func NewJoinRoomResponse(ID string, errCode int32, room uuid.UUID) *JoinRoomResponse {
-	// 是否加入校验？
+// NewJoinRoomResponse VersionThree及以上的回复需要在ToBytes之后调用Sign
+func NewJoinRoomResponse(version uint32, ID string, errCode int32, room uuid.UUID, token string) *JoinRoomResponse {
 	return &JoinRoomResponse{
+		Version: version,
 		ID:      ID,
 		ErrCode: errCode,
 		Room:    room,
+		Token:   token,
 	}
 }
 
-func NewReflexResponse(addr *net.UDPAddr, token string) *ReflexResponse {
+// NewLeaveRoomResponse VersionThree及以上的回复需要在ToBytes之后调用Sign。
+// 通知对端时ID使用LeaveNotifyID
+func NewLeaveRoomResponse(version uint32, ID string, errCode int32, room uuid.UUID) *LeaveRoomResponse {
+	return &LeaveRoomResponse{
+		Version: version,
+		ID:      ID,
+		ErrCode: errCode,
+		Room:    room,
+	}
+}
+
+// NewRebindResponse VersionThree及以上的回复需要在ToBytes之后调用Sign
+func NewRebindResponse(version uint32, ID string, errCode int32, room uuid.UUID) *RebindResponse {
+	return &RebindResponse{
+		Version: version,
+		ID:      ID,
+		ErrCode: errCode,
+		Room:    room,
+	}
+}
+
+// NewKeepaliveRequest ID为空或16字节
+func NewKeepaliveRequest(version uint32, ID string, room uuid.UUID, t time.Time) *KeepaliveRequest {
+	return &KeepaliveRequest{
+		Version: version,
+		ID:      ID,
+		Room:    room,
+		Time:    t,
+	}
+}
+
+// NewKeepaliveResponse ID和Time使用请求中的值
+func NewKeepaliveResponse(version uint32, ID string, room uuid.UUID, t time.Time) *KeepaliveResponse {
+	return &KeepaliveResponse{
+		Version: version,
+		ID:      ID,
+		Room:    room,
+		Time:    t,
+	}
+}
+
+// NewReflexResponse 使用与请求相同的协议版本回复，
+// 旧版本(VersionTwo)客户端来自IPv6地址时无法回复
+func NewReflexResponse(version uint32, addr *net.UDPAddr, token string) *ReflexResponse {
 	return &ReflexResponse{
-		Addr:  addr,
-		Token: token,
+		Version: version,
+		Addr:    addr,
+		Token:   token,
 	}
 }
 
 func (m *CreateRoomResponse) ToBytes() []byte {
-	if len(m.ID) != 16 || len(m.Room) != 16 {
+	if len(m.ID) != 16 || len(m.Room) != 16 || len(m.Token) > common.Fixed16 {
 		return nil
 	}
-	msg := baseMessage{
+	msg := baseMessageV3{
 		Magic:   MsgMagic,
-		Version: VersionTwo,
+		Version: m.Version,
 		Type:    TypeCreateRoomResponse,
 		Errcode: m.ErrCode,
 		Time:    time.Now().Unix(),
+		Family:  FamilyIPv4,
 	}
 	copy(msg.ID[:], []byte(m.ID))
 	copy(msg.Room[:], m.Room[:])
-	buffer := bytes.Buffer{}
-	binary.Write(&buffer, binary.LittleEndian, msg)
-	// integrity?
-	return buffer.Bytes()
+	copy(msg.Token[:], []byte(m.Token))
+	return encode(&msg)
 }
 
 func (m *JoinRoomResponse) ToBytes() []byte {
+	if len(m.ID) != 16 || len(m.Room) != 16 || len(m.Token) > common.Fixed16 {
+		return nil
+	}
+	msgType := TypeJoinRoomResponse
+	if m.Version == VersionTwo {
+		// VersionTwo一直用TypeCreateRoomResponse回复加入room，保持兼容
+		msgType = TypeCreateRoomResponse
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    msgType,
+		Errcode: m.ErrCode,
+		Time:    time.Now().Unix(),
+		Family:  FamilyIPv4,
+		Room:    m.Room,
+	}
+	copy(msg.ID[:], []byte(m.ID))
+	copy(msg.Token[:], []byte(m.Token))
+	return encode(&msg)
+}
+
+func (m *LeaveRoomResponse) ToBytes() []byte {
 	if len(m.ID) != 16 || len(m.Room) != 16 {
 		return nil
 	}
-	msg := baseMessage{
+	msg := baseMessageV3{
 		Magic:   MsgMagic,
-		Version: VersionTwo,
-		Type:    TypeCreateRoomResponse,
+		Version: m.Version,
+		Type:    TypeLeaveRoomResponse,
 		Errcode: m.ErrCode,
 		Time:    time.Now().Unix(),
+		Family:  FamilyIPv4,
 		Room:    m.Room,
 	}
 	copy(msg.ID[:], []byte(m.ID))
-	buffer := bytes.Buffer{}
-	binary.Write(&buffer, binary.LittleEndian, msg)
-	// integrity?
-	return buffer.Bytes()
+	return encode(&msg)
+}
+
+func (m *RebindResponse) ToBytes() []byte {
+	if len(m.ID) != 16 || len(m.Room) != 16 {
+		return nil
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeRebindResponse,
+		Errcode: m.ErrCode,
+		Time:    time.Now().Unix(),
+		Family:  FamilyIPv4,
+		Room:    m.Room,
+	}
+	copy(msg.ID[:], []byte(m.ID))
+	return encode(&msg)
+}
+
+func (m *KeepaliveRequest) ToBytes() []byte {
+	if len(m.ID) > common.Fixed16 {
+		return nil
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeKeepaliveRequest,
+		Time:    m.Time.UnixMilli(),
+		Family:  FamilyIPv4,
+		Room:    m.Room,
+	}
+	copy(msg.ID[:], []byte(m.ID))
+	return encode(&msg)
+}
+
+func (m *KeepaliveResponse) ToBytes() []byte {
+	if len(m.ID) > common.Fixed16 {
+		return nil
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeKeepaliveResponse,
+		Time:    m.Time.UnixMilli(),
+		Family:  FamilyIPv4,
+		Room:    m.Room,
+	}
+	copy(msg.ID[:], []byte(m.ID))
+	return encode(&msg)
 }
 
 func (m *ReflexResponse) ToBytes() []byte {
-	msg := baseMessage{
+	msg := baseMessageV3{
 		Magic:   MsgMagic,
-		Version: VersionTwo,
+		Version: m.Version,
 		Type:    TypeReflexResponse,
-		IP:      binary.LittleEndian.Uint32(m.Addr.IP),
 		Port:    uint32(m.Addr.Port),
 	}
+	msg.setIP(m.Addr.IP)
 	copy(msg.Token[:], []byte(m.Token))
-	buffer := bytes.Buffer{}
-	binary.Write(&buffer, binary.LittleEndian, msg)
-	return buffer.Bytes()
+	return encode(&msg)
+}
+
+// 以下请求的ToBytes供客户端使用，Integrity字段为空，需要再调用Sign
+
+func (m *CreateRoomRequest) ToBytes() []byte {
+	if len(m.ID) != 16 || len(m.Username) > common.Fixed16 || len(m.Token) > common.Fixed16 {
+		return nil
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeCreateRoomRequest,
+		Time:    m.Time.Unix(),
+		Port:    m.Port,
+	}
+	msg.setIP(m.IP)
+	copy(msg.ID[:], []byte(m.ID))
+	copy(msg.Username[:], []byte(m.Username))
+	copy(msg.Token[:], []byte(m.Token))
+	return encode(&msg)
+}
+
+func (m *JoinRoomRequest) ToBytes() []byte {
+	if len(m.ID) != 16 || len(m.Username) > common.Fixed16 || len(m.Token) > common.Fixed16 {
+		return nil
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeJoinRoomRequest,
+		Time:    m.Time.Unix(),
+		Port:    m.Port,
+		Room:    m.Room,
+	}
+	msg.setIP(m.IP)
+	copy(msg.ID[:], []byte(m.ID))
+	copy(msg.Username[:], []byte(m.Username))
+	copy(msg.Token[:], []byte(m.Token))
+	return encode(&msg)
+}
+
+func (m *LeaveRoomRequest) ToBytes() []byte {
+	if len(m.ID) != 16 || len(m.Username) > common.Fixed16 || len(m.Token) > common.Fixed16 {
+		return nil
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeLeaveRoomRequest,
+		Time:    m.Time.Unix(),
+		Port:    m.Port,
+		Room:    m.Room,
+	}
+	msg.setIP(m.IP)
+	copy(msg.ID[:], []byte(m.ID))
+	copy(msg.Username[:], []byte(m.Username))
+	copy(msg.Token[:], []byte(m.Token))
+	return encode(&msg)
+}
+
+func (m *RebindRequest) ToBytes() []byte {
+	if len(m.ID) != 16 || len(m.Username) > common.Fixed16 || len(m.Token) > common.Fixed16 {
+		return nil
+	}
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeRebindRequest,
+		Time:    m.Time.Unix(),
+		Port:    m.Port,
+		Room:    m.Room,
+	}
+	msg.setIP(m.IP)
+	copy(msg.ID[:], []byte(m.ID))
+	copy(msg.Username[:], []byte(m.Username))
+	copy(msg.Token[:], []byte(m.Token))
+	return encode(&msg)
+}
+
+func (m *ReflexRequest) ToBytes() []byte {
+	msg := baseMessageV3{
+		Magic:   MsgMagic,
+		Version: m.Version,
+		Type:    TypeReflexRequest,
+		Family:  FamilyIPv4,
+	}
+	return encode(&msg)
 }
@@ -0,0 +1,287 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const testID = "0123456789abcdef"
+
+func newTestMessage(version uint32, msgType uint32, ip net.IP) *baseMessageV3 {
+	m := &baseMessageV3{
+		Magic:   MsgMagic,
+		Version: version,
+		Type:    msgType,
+		Time:    time.Now().Unix(),
+		Port:    40000,
+	}
+	m.setIP(ip)
+	copy(m.ID[:], testID)
+	copy(m.Username[:], "user1")
+	copy(m.Token[:], "tok")
+	return m
+}
+
+func TestCreateRoomRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint32
+		ip      net.IP
+		want    net.IP
+	}{
+		{"v2 ipv4", VersionTwo, net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.10")},
+		{"v3 ipv4", VersionThree, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")},
+		{"v3 ipv4-mapped", VersionThree, net.ParseIP("::ffff:10.0.0.2"), net.ParseIP("10.0.0.2")},
+		{"v3 ipv6", VersionThree, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMessage(tt.version, TypeCreateRoomRequest, tt.ip)
+			data := encode(m)
+			if len(data) != BaseMessageSize {
+				t.Fatalf("len(data) = %d, want %d", len(data), BaseMessageSize)
+			}
+			if !IsCreateRoomRequest(data) {
+				t.Fatalf("MessageType = 0x%x", MessageType(data))
+			}
+			parsed := ParseCreateRoomRequest(data)
+			if parsed == nil {
+				t.Fatal("ParseCreateRoomRequest returned nil")
+			}
+			if parsed.Version != tt.version || parsed.ID != testID || parsed.Username != "user1" ||
+				parsed.Time.Unix() != m.Time || parsed.Port != 40000 {
+				t.Fatalf("parsed = %+v", parsed)
+			}
+			if !parsed.IP.Equal(tt.want) {
+				t.Fatalf("IP = %v, want %v", parsed.IP, tt.want)
+			}
+			if parsed.Token[:3] != "tok" {
+				t.Fatalf("Token = %q", parsed.Token)
+			}
+		})
+	}
+}
+
+func TestJoinRoomRequestRoundTrip(t *testing.T) {
+	room := uuid.New()
+	now := time.Unix(time.Now().Unix(), 0)
+	tests := []struct {
+		name    string
+		version uint32
+		ip      net.IP
+		want    net.IP
+	}{
+		{"v2 ipv4", VersionTwo, net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.10")},
+		{"v3 ipv4", VersionThree, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1")},
+		{"v3 ipv4-mapped", VersionThree, net.ParseIP("::ffff:10.0.0.2"), net.ParseIP("10.0.0.2")},
+		{"v3 ipv6", VersionThree, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := JoinRoomRequest{
+				Version:  tt.version,
+				ID:       testID,
+				Username: "user1",
+				Time:     now,
+				IP:       tt.ip,
+				Port:     40000,
+				Token:    "tok",
+				Room:     room,
+			}
+			data := request.ToBytes()
+			if len(data) != BaseMessageSize {
+				t.Fatalf("len(data) = %d, want %d", len(data), BaseMessageSize)
+			}
+			if !IsJoinRoomRequest(data) {
+				t.Fatalf("MessageType = 0x%x", MessageType(data))
+			}
+			parsed := ParseJoinRoomRequest(data)
+			if parsed == nil {
+				t.Fatal("ParseJoinRoomRequest returned nil")
+			}
+			if parsed.Version != tt.version || parsed.ID != testID || parsed.Username != "user1" ||
+				!parsed.Time.Equal(now) || parsed.Port != 40000 || parsed.Room != room {
+				t.Fatalf("parsed = %+v", parsed)
+			}
+			if !parsed.IP.Equal(tt.want) {
+				t.Fatalf("IP = %v, want %v", parsed.IP, tt.want)
+			}
+			if parsed.Token[:3] != "tok" {
+				t.Fatalf("Token = %q", parsed.Token)
+			}
+		})
+	}
+}
+
+func TestV2RejectsIPv6(t *testing.T) {
+	if data := encode(newTestMessage(VersionTwo, TypeCreateRoomRequest, net.ParseIP("2001:db8::1"))); data != nil {
+		t.Fatalf("VersionTwo encoded an IPv6 address: %d bytes", len(data))
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	if data := NewReflexResponse(VersionTwo, addr, "tok").ToBytes(); data != nil {
+		t.Fatalf("VersionTwo ReflexResponse encoded an IPv6 address: %d bytes", len(data))
+	}
+	data := NewReflexResponse(VersionThree, addr, "tok").ToBytes()
+	if !IsReflexResponse(data) {
+		t.Fatalf("MessageType = 0x%x", MessageType(data))
+	}
+	if ip := decode(data).ip(); !ip.Equal(addr.IP) {
+		t.Fatalf("IP = %v, want %v", ip, addr.IP)
+	}
+}
+
+func TestResponseEncoding(t *testing.T) {
+	room := uuid.New()
+	for _, version := range []uint32{VersionTwo, VersionThree} {
+		data := NewCreateRoomResponse(version, testID, Err_AuthFailed, room, "").ToBytes()
+		if !IsCreateRoomResponse(data) {
+			t.Fatalf("version %d: MessageType = 0x%x", version, MessageType(data))
+		}
+		m := decode(data)
+		if m.Version != version || m.Errcode != Err_AuthFailed || string(m.ID[:]) != testID || m.Room != room {
+			t.Fatalf("version %d: decoded = %+v", version, m)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	room := uuid.New()
+	for _, version := range []uint32{VersionTwo, VersionThree} {
+		response := NewJoinRoomResponse(version, testID, Err_RoomInvalid, room, "")
+		data := response.ToBytes()
+		parsed := ParseJoinRoomResponse(data)
+		if parsed == nil {
+			t.Fatalf("version %d: ParseJoinRoomResponse returned nil", version)
+		}
+		if parsed.Version != version || parsed.ErrCode != Err_RoomInvalid || parsed.Room != room {
+			t.Fatalf("version %d: parsed = %+v", version, parsed)
+		}
+	}
+}
+
+func TestKeepaliveRoundTrip(t *testing.T) {
+	room := uuid.New()
+	now := time.UnixMilli(time.Now().UnixMilli())
+	data := NewKeepaliveRequest(VersionThree, testID, room, now).ToBytes()
+	request := ParseKeepaliveRequest(data)
+	if request == nil || request.ID != testID || request.Room != room || !request.Time.Equal(now) {
+		t.Fatalf("parsed = %+v", request)
+	}
+	data = NewKeepaliveResponse(VersionThree, request.ID, room, request.Time).ToBytes()
+	response := ParseKeepaliveResponse(data)
+	if response == nil || response.ID != testID || response.Room != room || !response.Time.Equal(now) {
+		t.Fatalf("parsed = %+v", response)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	valid := encode(newTestMessage(VersionThree, TypeReflexRequest, net.ParseIP("10.0.0.1")))
+	badMagic := append([]byte(nil), valid...)
+	badMagic[0] ^= 0xff
+	badVersion := append([]byte(nil), valid...)
+	badVersion[4] = 9
+	badType := append([]byte(nil), valid...)
+	badType[8] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"nil", nil},
+		{"short", valid[:BaseMessageSize-1]},
+		{"long", append(append([]byte(nil), valid...), 0)},
+		{"bad magic", badMagic},
+		{"bad version", badVersion},
+		{"bad type", badType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msgType := MessageType(tt.data); msgType != TypeUnknown {
+				t.Fatalf("MessageType = 0x%x, want TypeUnknown", msgType)
+			}
+		})
+	}
+	if ParseCreateRoomRequest(valid[:100]) != nil {
+		t.Fatal("ParseCreateRoomRequest accepted a short message")
+	}
+}
+
+func TestInvalidFamily(t *testing.T) {
+	// Family位于Time之后
+	const familyOffset = 4*4 + 8
+	for _, family := range []uint32{0, 5, 0xffffffff} {
+		data := encode(newTestMessage(VersionThree, TypeCreateRoomRequest, net.ParseIP("10.0.0.1")))
+		binary.LittleEndian.PutUint32(data[familyOffset:], family)
+		if request := ParseCreateRoomRequest(data); request != nil {
+			t.Errorf("family %d: parsed IP %v, want nil", family, request.IP)
+		}
+		if request := ParseReflexRequest(data); request != nil {
+			t.Errorf("family %d: ParseReflexRequest accepted the message", family)
+		}
+	}
+	// VersionTwo没有Family字段，同一位置是IP
+	data := encode(newTestMessage(VersionTwo, TypeCreateRoomRequest, net.ParseIP("10.0.0.1")))
+	if ParseCreateRoomRequest(data) == nil {
+		t.Error("ParseCreateRoomRequest rejected a VersionTwo message")
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	data := encode(newTestMessage(VersionThree, TypeCreateRoomRequest, net.ParseIP("10.0.0.1")))
+	Sign(data, "secret")
+	if !Verify(data, "secret") {
+		t.Fatal("Verify failed on a signed message")
+	}
+	if Verify(data, "other") {
+		t.Fatal("Verify accepted the wrong key")
+	}
+	parsed := ParseCreateRoomRequest(data)
+	if !bytes.Equal([]byte(parsed.Integrity), Integrity(data, "secret")) {
+		t.Fatal("parsed Integrity does not match")
+	}
+	tampered := []int{0, 8, 20, 30, BaseMessageSize - IntegritySize - 1, BaseMessageSize - 1}
+	for _, i := range tampered {
+		copied := append([]byte(nil), data...)
+		copied[i] ^= 0x01
+		if Verify(copied, "secret") {
+			t.Fatalf("Verify accepted a message tampered at byte %d", i)
+		}
+	}
+	if Verify(data[:BaseMessageSize-1], "secret") {
+		t.Fatal("Verify accepted a short message")
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// elapse 模拟经过了d时间
+func (b *Bucket) elapse(d time.Duration) {
+	b.mutex.Lock()
+	b.last = b.last.Add(-d)
+	b.mutex.Unlock()
+}
+
+func TestNilBucket(t *testing.T) {
+	b := NewBucket(0, 1000)
+	if b != nil {
+		t.Fatal("NewBucket with rate 0 returned a bucket")
+	}
+	if !b.Allow(1 << 30) {
+		t.Fatal("nil bucket limited a packet")
+	}
+	b.Refund(100)
+}
+
+func TestBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		burst uint64
+		want  int
+	}{
+		{"configured", 100000, 100000},
+		// 容量不足一个最大UDP包时按minBurst计算
+		{"minimum", 1000, minBurst},
+	}
+	for _, tt := range tests {
+		// 每毫秒补充1个令牌，测试过程中补充的令牌可以忽略
+		b := NewBucket(1000, tt.burst)
+		if !b.Allow(tt.want) {
+			t.Errorf("%s: full bucket rejected %d bytes", tt.name, tt.want)
+		}
+		if b.Allow(100) {
+			t.Errorf("%s: empty bucket allowed 100 bytes", tt.name)
+		}
+	}
+	b := NewBucket(1000, 100000)
+	if b.Allow(100001) {
+		t.Error("bucket allowed more than its burst")
+	}
+	// 失败时不扣减令牌
+	if !b.Allow(100000) {
+		t.Error("failed Allow consumed tokens")
+	}
+}
+
+func TestRefill(t *testing.T) {
+	b := NewBucket(1000, 100000)
+	b.Allow(100000)
+	b.elapse(500 * time.Millisecond)
+	if !b.Allow(400) {
+		t.Fatal("500ms refill rejected 400 bytes")
+	}
+	if b.Allow(400) {
+		t.Fatal("500ms refill allowed 800 bytes")
+	}
+	// 补充不超过容量
+	b.elapse(time.Hour)
+	if b.Allow(100001) {
+		t.Fatal("refill exceeded burst")
+	}
+	if !b.Allow(100000) {
+		t.Fatal("refill did not fill the bucket")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	b := NewBucket(1000, 100000)
+	b.Allow(100000)
+	b.Refund(500)
+	if !b.Allow(500) {
+		t.Fatal("refunded tokens not available")
+	}
+	b.Refund(1 << 30)
+	if b.Allow(100001) {
+		t.Fatal("refund exceeded burst")
+	}
+}
+
+func TestKbpsToBytes(t *testing.T) {
+	if got := KbpsToBytes(8); got != 1000 {
+		t.Fatalf("KbpsToBytes(8) = %d, want 1000", got)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	maxBatchSize = 1024 // UIO_MAXIOV
+	bufferSize   = 65536
+)
+
+// batchPacketConn ipv4.PacketConn和ipv6.PacketConn的公共部分，两者的Message是同一类型
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchConn 用recvmmsg/sendmmsg批量收发，只能在一个worker中使用。
+// 收包缓冲区在每轮读取之间循环使用，转发时直接引用收包缓冲区，
+// 所以每轮处理完之后、下一次读取之前必须flush
+type batchConn struct {
+	socket    *net.UDPConn
+	conn      batchPacketConn
+	readMsgs  []ipv4.Message
+	writeMsgs []ipv4.Message
+	pending   int
+}
+
+func newBatchConn(socket *net.UDPConn, size int) *batchConn {
+	if size > maxBatchSize {
+		size = maxBatchSize
+	}
+	bc := &batchConn{
+		socket:    socket,
+		readMsgs:  make([]ipv4.Message, size),
+		writeMsgs: make([]ipv4.Message, size),
+	}
+	if socket.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		bc.conn = ipv4.NewPacketConn(socket)
+	} else {
+		// 双栈socket发往IPv4地址时内核接受sockaddr_in，不需要转换成IPv4-mapped地址
+		bc.conn = ipv6.NewPacketConn(socket)
+	}
+	buffers := make([]byte, size*bufferSize)
+	for i := range bc.readMsgs {
+		bc.readMsgs[i].Buffers = [][]byte{buffers[i*bufferSize : (i+1)*bufferSize]}
+		bc.writeMsgs[i].Buffers = make([][]byte, 1)
+	}
+	return bc
+}
+
+func (bc *batchConn) read() (int, error) {
+	return bc.conn.ReadBatch(bc.readMsgs, 0)
+}
+
+// send 作为SessionManager的SendFunc，攒满一批再发
+func (bc *batchConn) send(addr *net.UDPAddr, data []byte) {
+	m := &bc.writeMsgs[bc.pending]
+	m.Buffers[0] = data
+	m.Addr = addr
+	bc.pending++
+	if bc.pending == len(bc.writeMsgs) {
+		bc.flush()
+	}
+}
+
+func (bc *batchConn) flush() {
+	sent := 0
+	for sent < bc.pending {
+		n, err := bc.conn.WriteBatch(bc.writeMsgs[sent:bc.pending], 0)
+		if err != nil {
+			// UDP不保证送达，跳过出错的包继续发送后面的
+			if n < 0 {
+				n = 0
+			}
+			logrus.Debugf("WriteBatch to %v failed: %v", bc.writeMsgs[sent+n].Addr, err)
+			n++
+		}
+		sent += n
+	}
+	for i := 0; i < bc.pending; i++ {
+		bc.writeMsgs[i].Buffers[0] = nil
+		bc.writeMsgs[i].Addr = nil
+	}
+	bc.pending = 0
+}
+
+func (svr *Server) startBatch(socket *net.UDPConn) {
+	bc := newBatchConn(socket, svr.batchSize)
+	for {
+		select {
+		case <-svr.stopChan:
+			return
+		default:
+		}
+		socket.SetReadDeadline(time.Now().Add(svr.ReadTimeout()))
+		n, err := bc.read()
+		if err != nil {
+			if os.IsTimeout(err) {
+				svr.sessionMgr.HandleIdle(bc.send)
+				bc.flush()
+				continue
+			} else {
+				logrus.Errorf("ReadBatch error: %v", err)
+				os.Exit(-1)
+			}
+		}
+		for i := 0; i < n; i++ {
+			m := &bc.readMsgs[i]
+			addr, ok := m.Addr.(*net.UDPAddr)
+			if m.N == 0 || !ok || !svr.sessionMgr.AllowAddr(addr) {
+				continue
+			}
+			svr.sessionMgr.HandlePacket(addr, m.Buffers[0][:m.N], bc.send)
+		}
+		bc.flush()
+	}
+}
@@ -33,50 +33,126 @@ package server
 import (
 	"net"
 	"os"
+	"relay/internal/msg"
 	"relay/internal/session"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// PrintStats每秒被调用一次，但只按这个间隔输出
+const statsInterval = time.Minute
+
 type Server struct {
-	socket     *net.UDPConn
-	stopChan   chan struct{}
-	stopedChan chan struct{}
-	sessionMgr *session.SessionManager
+	sockets       []*net.UDPConn // 每个worker一个socket，不支持SO_REUSEPORT时共用同一个
+	stopChan      chan struct{}
+	stopedChan    chan struct{}
+	stopOnce      sync.Once
+	workers       sync.WaitGroup
+	batchSize     int // 大于1时批量收发
+	sessionMgr    *session.SessionManager
+	lastStats     session.StatsSnapshot
+	lastStatsTime time.Time
 }
 
-func New(ip string, port uint16) *Server {
+// New workers为worker数量，小于等于0时使用CPU核数；batchSize为每次批量收发的最大包数，小于等于1时逐个收发
+func New(ip string, port uint16, workers int, batchSize int) *Server {
 	ipaddr := net.ParseIP(ip)
 	if ipaddr == nil {
 		logrus.Errorf("Parse ip %s failed", ip)
 		return nil
 	}
-	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: ipaddr, Port: int(port)})
+	laddr := &net.UDPAddr{IP: ipaddr, Port: int(port)}
+	if ipaddr.IsUnspecified() {
+		// 0.0.0.0或::都按双栈监听，同时服务IPv4和IPv6客户端
+		laddr.IP = nil
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	sockets, err := listen(laddr, workers)
 	if err != nil {
 		logrus.Errorf("ListenUDP on %s:%d failed: %v", ip, port, err)
 		return nil
 	}
 	sessionMgr := session.NewManager()
 	if sessionMgr == nil {
+		for _, socket := range sockets {
+			socket.Close()
+		}
 		return nil
 	}
-	svr := &Server{
-		socket:     socket,
-		stopChan:   make(chan struct{}),
-		stopedChan: make(chan struct{}, 2),
-		sessionMgr: sessionMgr,
+	logrus.Infof("Relay server listening on %s with %d workers", sockets[0].LocalAddr().String(), len(sockets))
+	return &Server{
+		sockets:       sockets,
+		stopChan:      make(chan struct{}),
+		stopedChan:    make(chan struct{}, 2),
+		batchSize:     batchSize,
+		sessionMgr:    sessionMgr,
+		lastStats:     sessionMgr.Stats().Snapshot(),
+		lastStatsTime: time.Now(),
 	}
-	svr.sessionMgr.SetSendFunc(svr.sendMessage)
-	return svr
+}
+
+// listen 创建n个绑定到同一地址的socket，由内核按四元组哈希把包分给各个socket，
+// 同一客户端的包总是落在同一个worker上。平台不支持SO_REUSEPORT时所有worker共用一个socket
+func listen(laddr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	if !reusePortSupported {
+		socket, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		sockets := make([]*net.UDPConn, n)
+		for i := range sockets {
+			sockets[i] = socket
+		}
+		return sockets, nil
+	}
+	sockets := make([]*net.UDPConn, 0, n)
+	for i := 0; i < n; i++ {
+		socket, err := listenReusePort(laddr)
+		if err != nil {
+			for _, s := range sockets {
+				s.Close()
+			}
+			return nil, err
+		}
+		if laddr.Port == 0 {
+			// 端口由系统分配时，剩下的socket要绑定到同一个端口
+			addr := *laddr
+			addr.Port = socket.LocalAddr().(*net.UDPAddr).Port
+			laddr = &addr
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets, nil
 }
 
 func (svr *Server) Start() {
-	go svr.start()
+	svr.workers.Add(len(svr.sockets))
+	for _, socket := range svr.sockets {
+		go svr.start(socket)
+	}
+	go func() {
+		svr.workers.Wait()
+		// 不支持SO_REUSEPORT时所有worker共用同一个socket
+		svr.sockets[0].Close()
+		for _, socket := range svr.sockets[1:] {
+			if socket != svr.sockets[0] {
+				socket.Close()
+			}
+		}
+		logrus.Info("Relay server stoped.")
+		svr.stopedChan <- struct{}{}
+	}()
 }
 
 func (svr *Server) Stop() {
-	svr.stopChan <- struct{}{}
+	svr.stopOnce.Do(func() {
+		close(svr.stopChan)
+	})
 }
 
 func (svr *Server) ReadTimeout() time.Duration {
@@ -87,14 +163,78 @@ func (svr *Server) StopedChan() chan struct{} {
 	return svr.stopedChan
 }
 
+func (svr *Server) SessionManager() *session.SessionManager {
+	return svr.sessionMgr
+}
+
+// Drain 拒绝创建新的room，等待已有的room全部结束或超时，返回的chan在结束时关闭。
+// 之后仍需调用Stop
+func (svr *Server) Drain(timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	svr.sessionMgr.Drain()
+	go func() {
+		defer close(done)
+		deadline := time.Now().Add(timeout)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		lastRooms := -1
+		for {
+			rooms, halfOpen := svr.sessionMgr.RoomCounts()
+			if rooms == 0 {
+				logrus.Info("Drain finished, all rooms closed")
+				return
+			}
+			left := time.Until(deadline)
+			if left <= 0 {
+				logrus.Warnf("Drain timeout, %d rooms will be closed", rooms)
+				return
+			}
+			if rooms != lastRooms {
+				logrus.Infof("Draining: %d rooms remaining (%d half open), %v left", rooms, halfOpen, left.Round(time.Second))
+				lastRooms = rooms
+			}
+			<-ticker.C
+		}
+	}()
+	return done
+}
+
 func (svr *Server) PrintStats() {
+	now := time.Now()
+	elapsed := now.Sub(svr.lastStatsTime)
+	if elapsed < statsInterval {
+		return
+	}
+	stats := svr.sessionMgr.Stats().Snapshot()
+	last := svr.lastStats
+	svr.lastStats = stats
+	svr.lastStatsTime = now
+	logrus.Infof("Stats: %d rooms active, %d created, %d removed",
+		stats.RoomsCreated-stats.RoomsRemoved, stats.RoomsCreated, stats.RoomsRemoved)
+	logrus.Infof("Stats: req_to_resp %d packets %d bytes (%.1f kbps), dropped %d packets %d bytes",
+		stats.ReqToResp.Packets, stats.ReqToResp.Bytes, kbps(stats.ReqToResp.Bytes-last.ReqToResp.Bytes, elapsed),
+		stats.ReqToResp.DroppedPackets, stats.ReqToResp.DroppedBytes)
+	logrus.Infof("Stats: resp_to_req %d packets %d bytes (%.1f kbps), dropped %d packets %d bytes",
+		stats.RespToReq.Packets, stats.RespToReq.Bytes, kbps(stats.RespToReq.Bytes-last.RespToReq.Bytes, elapsed),
+		stats.RespToReq.DroppedPackets, stats.RespToReq.DroppedBytes)
+	logrus.Infof("Stats: create_room %d, join_room %d, leave_room %d, rebind %d, keepalive %d, reflex %d, unknown %d, invalid %d, auth_failed %d, banned %d, rate_limited %d/%d (ip/global), denied %d",
+		stats.ControlPackets[msg.TypeCreateRoomRequest], stats.ControlPackets[msg.TypeJoinRoomRequest],
+		stats.ControlPackets[msg.TypeLeaveRoomRequest], stats.ControlPackets[msg.TypeRebindRequest], stats.ControlPackets[msg.TypeKeepaliveRequest], stats.ControlPackets[msg.TypeReflexRequest], stats.UnknownPackets, stats.InvalidPackets, stats.AuthFailures, stats.BannedRequests, stats.IPLimited, stats.GlobalLimited, stats.DeniedPackets)
+}
 
+func kbps(bytes uint64, elapsed time.Duration) float64 {
+	return float64(bytes) * 8 / 1000 / elapsed.Seconds()
 }
 
-func (svr *Server) start() {
-	defer func() {
-		svr.stopedChan <- struct{}{}
-	}()
+func (svr *Server) start(socket *net.UDPConn) {
+	defer svr.workers.Done()
+	if svr.batchSize > 1 {
+		svr.startBatch(socket)
+		return
+	}
+	send := func(addr *net.UDPAddr, data []byte) {
+		socket.WriteToUDP(data, addr)
+	}
 	data := make([]byte, 65536)
 	for {
 		select {
@@ -102,24 +242,20 @@ func (svr *Server) start() {
 			return
 		default:
 		}
-		svr.socket.SetDeadline(time.Now().Add(svr.ReadTimeout()))
-		nread, remoteAddr, err := svr.socket.ReadFromUDP(data)
+		socket.SetReadDeadline(time.Now().Add(svr.ReadTimeout()))
+		nread, remoteAddr, err := socket.ReadFromUDP(data)
 		if err != nil {
 			if os.IsTimeout(err) {
-				svr.sessionMgr.HandleIdle()
+				svr.sessionMgr.HandleIdle(send)
 				continue
 			} else {
 				logrus.Errorf("ReadFromUDP error: %v", err)
 				os.Exit(-1)
 			}
 		}
-		if nread == 0 {
+		if nread == 0 || !svr.sessionMgr.AllowAddr(remoteAddr) {
 			continue
 		}
-		svr.sessionMgr.HandlePacket(remoteAddr, data[:nread])
+		svr.sessionMgr.HandlePacket(remoteAddr, data[:nread], send)
 	}
 }
-
-func (svr *Server) sendMessage(addr *net.UDPAddr, data []byte) {
-	svr.socket.WriteToUDP(data, addr)
-}
@@ -0,0 +1,114 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"relay/client"
+
+	"github.com/sirupsen/logrus"
+)
+
+// offeredPPS 发送方的速率，与README中cmd/relay-bench的测试条件相同
+const offeredPPS = 100000
+
+// benchmarkRelay 在本机启动单worker的relay，通过一个room以offeredPPS的速率发送b.N个1200字节的包，
+// 按接收方实际收到的包数计算转发pps。转发能力不足时会丢包，丢包率单独输出
+func benchmarkRelay(b *testing.B, batchSize int) {
+	logrus.SetLevel(logrus.WarnLevel)
+	svr := New("127.0.0.1", 0, 1, batchSize)
+	if svr == nil {
+		b.Fatal("New failed")
+	}
+	svr.Start()
+	defer func() {
+		svr.Stop()
+		<-svr.StopedChan()
+		svr.sockets[0].Close()
+	}()
+	relayAddr := svr.sockets[0].LocalAddr().String()
+	opts := client.Options{Username: "user1", Password: "password1"}
+	sender, err := client.CreateRoom(relayAddr, opts)
+	if err != nil {
+		b.Fatalf("CreateRoom failed: %v", err)
+	}
+	defer sender.Close()
+	receiver, err := client.JoinRoom(relayAddr, sender.Room(), opts)
+	if err != nil {
+		b.Fatalf("JoinRoom failed: %v", err)
+	}
+	defer receiver.Close()
+
+	b.ResetTimer()
+	start := time.Now()
+	go func() {
+		payload := make([]byte, 1200)
+		// 每毫秒发送一批，避免单个包sleep的精度问题
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; i < b.N; {
+			for j := 0; j < offeredPPS/1000 && i < b.N; j++ {
+				sender.Write(payload)
+				i++
+			}
+			<-ticker.C
+		}
+	}()
+	received := 0
+	last := start
+	buffer := make([]byte, 65536)
+	for received < b.N {
+		// 一段时间收不到包说明剩下的已经丢了
+		receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := receiver.Read(buffer); err != nil {
+			break
+		}
+		received++
+		last = time.Now()
+	}
+	b.StopTimer()
+	if elapsed := last.Sub(start); received > 0 && elapsed > 0 {
+		b.ReportMetric(float64(received)/elapsed.Seconds(), "pps")
+	}
+	b.ReportMetric(float64(b.N-received)*100/float64(b.N), "loss%")
+}
+
+// 对比逐个收发和批量收发：
+// go test -run '^$' -bench Relay -benchtime 200000x ./internal/server
+func BenchmarkRelayPerPacket(b *testing.B) {
+	benchmarkRelay(b, 1)
+}
+
+func BenchmarkRelayBatch32(b *testing.B) {
+	benchmarkRelay(b, 32)
+}
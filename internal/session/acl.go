@@ -0,0 +1,150 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"net"
+	"reflect"
+	"relay/internal/acl"
+	"relay/internal/conf"
+	"relay/internal/msg"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// accessControl 全局和按用户的网段限制。列表可以通过mgr接口修改，
+// 重新加载配置时只有配置文件中的列表变化了才会覆盖
+type accessControl struct {
+	network   *acl.List
+	mutex     sync.RWMutex // 保护users和加载的配置
+	users     map[string]*acl.List
+	netConf   acl.Rules
+	usersConf map[string]acl.Rules
+}
+
+func newAccessControl() *accessControl {
+	network, _ := acl.New(acl.Rules{})
+	a := &accessControl{
+		network: network,
+		users:   make(map[string]*acl.List),
+	}
+	a.load()
+	return a
+}
+
+func (a *accessControl) load() {
+	netConf := acl.Rules{Allow: conf.Xml.Net.Allow, Deny: conf.Xml.Net.Deny}
+	usersConf := make(map[string]acl.Rules)
+	for _, user := range conf.Xml.Auth.Users {
+		if len(user.Allow) != 0 || len(user.Deny) != 0 {
+			usersConf[user.Username] = acl.Rules{Allow: user.Allow, Deny: user.Deny}
+		}
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !reflect.DeepEqual(netConf, a.netConf) {
+		// 配置已经校验过
+		if err := a.network.Set(netConf); err != nil {
+			logrus.Errorf("Load net acl failed: %v", err)
+		}
+		a.netConf = netConf
+	}
+	if !reflect.DeepEqual(usersConf, a.usersConf) {
+		users := make(map[string]*acl.List)
+		for username, rules := range usersConf {
+			list, err := acl.New(rules)
+			if err != nil {
+				logrus.Errorf("Load acl of user %s failed: %v", username, err)
+				continue
+			}
+			users[username] = list
+		}
+		a.users = users
+		a.usersConf = usersConf
+	}
+}
+
+// userAllowed 没有为用户配置网段限制时总是允许
+func (a *accessControl) userAllowed(username string, ip net.IP) bool {
+	a.mutex.RLock()
+	list, exists := a.users[username]
+	a.mutex.RUnlock()
+	return !exists || list.Allowed(ip)
+}
+
+// AllowAddr 在HandlePacket之前调用，不在允许网段内的包直接丢弃
+func (mgr *SessionManager) AllowAddr(addr *net.UDPAddr) bool {
+	if mgr.access.network.Allowed(addr.IP) {
+		return true
+	}
+	mgr.stats.DeniedPackets.Add(1)
+	return false
+}
+
+// NetACL 返回全局网段列表，修改立即生效
+func (mgr *SessionManager) NetACL() *acl.List {
+	return mgr.access.network
+}
+
+// UserACL 返回用户的网段列表，不存在时create为true则创建一个空列表，否则返回nil
+func (mgr *SessionManager) UserACL(username string, create bool) *acl.List {
+	mgr.access.mutex.Lock()
+	defer mgr.access.mutex.Unlock()
+	list, exists := mgr.access.users[username]
+	if !exists && create {
+		list, _ = acl.New(acl.Rules{})
+		mgr.access.users[username] = list
+	}
+	return list
+}
+
+// UserACLs 返回所有配置了网段限制的用户及其列表
+func (mgr *SessionManager) UserACLs() map[string]acl.Rules {
+	mgr.access.mutex.RLock()
+	defer mgr.access.mutex.RUnlock()
+	users := make(map[string]acl.Rules, len(mgr.access.users))
+	for username, list := range mgr.access.users {
+		if !list.Empty() {
+			users[username] = list.Rules()
+		}
+	}
+	return users
+}
+
+// checkUserAddr 验证通过后检查用户的网段限制，与验证中的地址校验一样返回Err_AddressInvalid
+func (mgr *SessionManager) checkUserAddr(addr *net.UDPAddr, username string) int32 {
+	if mgr.access.userAllowed(username, addr.IP) {
+		return msg.Err_OK
+	}
+	logrus.Warnf("Packet(user:%s) from %s not allowed by user acl", username, addr.String())
+	return msg.Err_AddressInvalid
+}
@@ -0,0 +1,239 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"net"
+	"relay/internal/conf"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BanKindIP   = "ip"
+	BanKindUser = "user"
+)
+
+// BanInfo 封禁记录的快照
+type BanInfo struct {
+	Kind  string // BanKindIP或BanKindUser
+	Key   string // IP或用户名
+	Until time.Time
+	Bans  int // 连续被封禁的次数，决定下一次封禁的时长
+}
+
+type banEntry struct {
+	failures    []time.Time // 窗口内的失败时间，按时间顺序
+	bannedUntil time.Time
+	bans        int
+}
+
+// banList 按来源IP和用户名统计验证失败，失败过多时暂时封禁。
+// 有自己的锁，可以在持有SessionManager.mutex时调用
+type banList struct {
+	mutex       sync.Mutex
+	maxFailures int
+	window      time.Duration
+	banTime     time.Duration
+	maxBanTime  time.Duration
+	allow       []*net.IPNet
+	ips         map[string]*banEntry
+	users       map[string]*banEntry
+}
+
+func newBanList() *banList {
+	b := &banList{
+		ips:   make(map[string]*banEntry),
+		users: make(map[string]*banEntry),
+	}
+	b.load()
+	return b
+}
+
+// load 读取conf.Xml中的封禁配置，已有的封禁保持不变
+func (b *banList) load() {
+	cfg := conf.Xml.Ban
+	var allow []*net.IPNet
+	for _, cidr := range cfg.Allow {
+		// 配置已经校验过
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			allow = append(allow, ipNet)
+		}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.maxFailures = cfg.MaxFailures
+	b.window = secondsOr(cfg.Window, time.Minute)
+	b.banTime = secondsOr(cfg.BanTime, time.Minute)
+	b.maxBanTime = secondsOr(cfg.MaxBanTime, time.Hour)
+	b.allow = allow
+}
+
+func secondsOr(seconds int, def time.Duration) time.Duration {
+	if seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (b *banList) allowed(ip net.IP) bool {
+	for _, ipNet := range b.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned 来源IP或用户名被封禁时返回true，白名单中的IP不受用户名封禁的影响
+func (b *banList) isBanned(ip net.IP, username string, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.maxFailures <= 0 || b.allowed(ip) {
+		return false
+	}
+	if entry, exists := b.ips[ip.String()]; exists && now.Before(entry.bannedUntil) {
+		return true
+	}
+	entry, exists := b.users[username]
+	return exists && now.Before(entry.bannedUntil)
+}
+
+// fail 记录一次验证失败，返回因此新增的封禁数。username为空时只计入IP，白名单中的IP不计数
+func (b *banList) fail(ip net.IP, username string, now time.Time) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.maxFailures <= 0 || b.allowed(ip) {
+		return 0
+	}
+	bans := 0
+	if b.record(b.ips, BanKindIP, ip.String(), now) {
+		bans++
+	}
+	if username != "" && b.record(b.users, BanKindUser, username, now) {
+		bans++
+	}
+	return bans
+}
+
+// record 记录一次失败，达到上限时封禁并返回true
+func (b *banList) record(entries map[string]*banEntry, kind string, key string, now time.Time) bool {
+	entry, exists := entries[key]
+	if !exists {
+		entry = &banEntry{}
+		entries[key] = entry
+	}
+	if now.Before(entry.bannedUntil) {
+		// 封禁前已经在处理的请求
+		return false
+	}
+	entry.expireFailures(now, b.window)
+	entry.failures = append(entry.failures, now)
+	if len(entry.failures) < b.maxFailures {
+		return false
+	}
+	// 每次再被封禁时长加倍
+	duration := b.banTime
+	for i := 0; i < entry.bans && duration < b.maxBanTime; i++ {
+		duration *= 2
+	}
+	if duration > b.maxBanTime {
+		duration = b.maxBanTime
+	}
+	logrus.Warnf("Banning %s %s for %v after %d auth failures in %v", kind, key, duration, len(entry.failures), b.window)
+	entry.bannedUntil = now.Add(duration)
+	entry.bans++
+	entry.failures = nil
+	return true
+}
+
+func (e *banEntry) expireFailures(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(e.failures) && now.Sub(e.failures[i]) >= window {
+		i++
+	}
+	e.failures = e.failures[i:]
+}
+
+// lift 解除封禁并清空失败记录，返回是否存在该封禁
+func (b *banList) lift(kind string, key string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entries := b.ips
+	if kind == BanKindUser {
+		entries = b.users
+	}
+	entry, exists := entries[key]
+	if !exists {
+		return false
+	}
+	delete(entries, key)
+	banned := time.Now().Before(entry.bannedUntil)
+	if banned {
+		logrus.Infof("Lifted ban on %s %s by admin", kind, key)
+	}
+	return banned
+}
+
+// list 返回当前生效的封禁，按解封时间排序
+func (b *banList) list(now time.Time) []BanInfo {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	infos := []BanInfo{}
+	for kind, entries := range map[string]map[string]*banEntry{BanKindIP: b.ips, BanKindUser: b.users} {
+		for key, entry := range entries {
+			if now.Before(entry.bannedUntil) {
+				infos = append(infos, BanInfo{Kind: kind, Key: key, Until: entry.bannedUntil, Bans: entry.bans})
+			}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Until.Before(infos[j].Until)
+	})
+	return infos
+}
+
+// clean 删除过期的失败记录。解封后max_ban_time内没有再被封禁，才清零封禁次数
+func (b *banList) clean(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, entries := range []map[string]*banEntry{b.ips, b.users} {
+		for key, entry := range entries {
+			entry.expireFailures(now, b.window)
+			if len(entry.failures) == 0 && now.Sub(entry.bannedUntil) >= b.maxBanTime {
+				delete(entries, key)
+			}
+		}
+	}
+}
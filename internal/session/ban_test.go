@@ -0,0 +1,176 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestBanList(allow ...string) *banList {
+	b := newBanList()
+	b.maxFailures = 3
+	b.window = time.Minute
+	b.banTime = time.Minute
+	b.maxBanTime = 4 * time.Minute
+	b.allow = nil
+	for _, cidr := range allow {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		b.allow = append(b.allow, ipNet)
+	}
+	return b
+}
+
+func TestBanIPOnly(t *testing.T) {
+	b := newTestBanList()
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	for i := 0; i < 2; i++ {
+		if bans := b.fail(ip, "", now); bans != 0 {
+			t.Fatalf("failure #%d banned", i)
+		}
+	}
+	if b.isBanned(ip, "", now) {
+		t.Fatal("banned before max_failures")
+	}
+	if bans := b.fail(ip, "", now); bans != 1 {
+		t.Fatalf("fail returned %d bans, want 1", bans)
+	}
+	if !b.isBanned(ip, "user1", now) {
+		t.Fatal("ip not banned")
+	}
+	// 只计入IP的失败不影响用户名
+	if b.isBanned(net.ParseIP("10.0.0.2"), "user1", now) {
+		t.Fatal("username banned by failures counted against the ip only")
+	}
+}
+
+func TestBanUserAcrossIPs(t *testing.T) {
+	b := newTestBanList()
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		b.fail(net.IPv4(10, 0, 0, byte(i)), "user1", now)
+	}
+	if !b.isBanned(net.ParseIP("10.0.0.9"), "user1", now) {
+		t.Fatal("username not banned after failures from several ips")
+	}
+	if b.isBanned(net.ParseIP("10.0.0.1"), "user2", now) {
+		t.Fatal("ip banned after a single failure")
+	}
+}
+
+func TestBanWindow(t *testing.T) {
+	b := newTestBanList()
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	b.fail(ip, "", now)
+	b.fail(ip, "", now.Add(30*time.Second))
+	b.fail(ip, "", now.Add(61*time.Second))
+	if b.isBanned(ip, "", now.Add(61*time.Second)) {
+		t.Fatal("failure outside the window counted")
+	}
+	b.fail(ip, "", now.Add(62*time.Second))
+	if !b.isBanned(ip, "", now.Add(62*time.Second)) {
+		t.Fatal("3 failures within the window not banned")
+	}
+}
+
+func TestBanBackoff(t *testing.T) {
+	b := newTestBanList()
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		for i := 0; i < 3; i++ {
+			b.fail(ip, "", now)
+		}
+		infos := b.list(now)
+		if len(infos) != 1 || infos[0].Until.Sub(now) != want {
+			t.Fatalf("list = %+v, want a ban for %v", infos, want)
+		}
+		// 封禁期间的失败不计数
+		if bans := b.fail(ip, "", now); bans != 0 {
+			t.Fatal("failure while banned started a new ban")
+		}
+		now = infos[0].Until
+	}
+}
+
+func TestBanAllow(t *testing.T) {
+	b := newTestBanList("10.0.0.0/24")
+	now := time.Now()
+	allowed := net.ParseIP("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		if bans := b.fail(allowed, "user1", now); bans != 0 {
+			t.Fatal("failure from an allowed ip counted")
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		b.fail(net.IPv4(192, 168, 0, byte(i)), "user1", now)
+	}
+	if !b.isBanned(net.ParseIP("192.168.0.9"), "user1", now) {
+		t.Fatal("username not banned")
+	}
+	if b.isBanned(allowed, "user1", now) {
+		t.Fatal("allowed ip affected by the username ban")
+	}
+	b.maxFailures = 0
+	if b.isBanned(net.ParseIP("192.168.0.9"), "user1", now) {
+		t.Fatal("max_failures 0 should disable bans")
+	}
+}
+
+func TestBanLiftAndClean(t *testing.T) {
+	b := newTestBanList()
+	now := time.Now()
+	ip := net.ParseIP("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		b.fail(ip, "user1", now)
+	}
+	if len(b.list(now)) != 2 {
+		t.Fatalf("list = %+v, want ip and user bans", b.list(now))
+	}
+	if !b.lift(BanKindUser, "user1") || b.lift(BanKindUser, "user1") {
+		t.Fatal("lift should succeed once")
+	}
+	if b.isBanned(net.ParseIP("10.0.0.2"), "user1", now) {
+		t.Fatal("username still banned after lift")
+	}
+	// 解封后max_ban_time内仍然保留封禁次数
+	b.clean(now.Add(time.Minute + time.Second))
+	if _, exists := b.ips[ip.String()]; !exists {
+		t.Fatal("entry removed before max_ban_time")
+	}
+	b.clean(now.Add(5*time.Minute + time.Second))
+	if len(b.ips) != 0 || len(b.users) != 0 {
+		t.Fatal("expired entries not cleaned")
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"net"
+	"relay/internal/conf"
+	"relay/internal/ratelimit"
+	"sync"
+	"time"
+)
+
+const (
+	// maxControlIPs 最多为多少个IP单独计数，防止伪造来源地址的洪水耗尽内存。
+	// 超过后新的IP只受全局限速约束
+	maxControlIPs = 100000
+	// 空闲超过这个时间的IP令牌桶已经装满，与新建的没有区别，可以删除
+	controlIdleTime = 10 * time.Second
+)
+
+// controlLimiter 按来源IP和全局限制每秒处理的控制消息数，令牌单位为包。
+// 容量取一秒的量，客户端reflex、创建、加入room的几个请求不会受影响
+type controlLimiter struct {
+	mutex  sync.Mutex
+	perIP  uint64
+	global *ratelimit.Bucket
+	ips    map[string]*ipBucket
+}
+
+type ipBucket struct {
+	bucket *ratelimit.Bucket
+	last   time.Time
+}
+
+func newControlLimiter() *controlLimiter {
+	l := &controlLimiter{}
+	l.load()
+	return l
+}
+
+// load 按conf.Xml重新设置限速，已有的计数清零
+func (l *controlLimiter) load() {
+	cfg := conf.Xml.RateLimit
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.perIP = uint64(cfg.ControlPerIP)
+	l.global = ratelimit.NewPacketBucket(uint64(cfg.ControlGlobal), uint64(cfg.ControlGlobal))
+	l.ips = make(map[string]*ipBucket)
+}
+
+// allow 返回是否处理来自ip的控制消息，不处理时ipLimited表示是否是被单个IP的限速拦下的。
+// 先检查单个IP，避免一个IP的洪水消耗全局的令牌
+func (l *controlLimiter) allow(ip net.IP, now time.Time) (allowed bool, ipLimited bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.perIP != 0 {
+		key := ip.String()
+		b, exists := l.ips[key]
+		if !exists && len(l.ips) < maxControlIPs {
+			b = &ipBucket{bucket: ratelimit.NewPacketBucket(l.perIP, l.perIP)}
+			l.ips[key] = b
+		}
+		if b != nil {
+			b.last = now
+			if !b.bucket.Allow(1) {
+				return false, true
+			}
+		}
+	}
+	return l.global.Allow(1), false
+}
+
+func (l *controlLimiter) clean(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, b := range l.ips {
+		if now.Sub(b.last) >= controlIdleTime {
+			delete(l.ips, key)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"relay/internal/conf"
+)
+
+// newTestControlLimiter 按给定的限速创建controlLimiter，0表示不限
+func newTestControlLimiter(t *testing.T, perIP uint32, global uint32) *controlLimiter {
+	t.Helper()
+	old := conf.Xml
+	t.Cleanup(func() { conf.Xml = old })
+	conf.Xml.RateLimit.ControlPerIP = perIP
+	conf.Xml.RateLimit.ControlGlobal = global
+	return newControlLimiter()
+}
+
+func TestControlLimiterPerIP(t *testing.T) {
+	l := newTestControlLimiter(t, 3, 100)
+	now := time.Now()
+	a := net.ParseIP("10.0.0.1")
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow(a, now); !allowed {
+			t.Fatalf("request #%d from %v rejected", i, a)
+		}
+	}
+	if allowed, ipLimited := l.allow(a, now); allowed || !ipLimited {
+		t.Fatalf("4th request: allowed = %v, ipLimited = %v, want rejected by the per-IP limit", allowed, ipLimited)
+	}
+	// 其他IP不受影响
+	if allowed, _ := l.allow(net.ParseIP("10.0.0.2"), now); !allowed {
+		t.Fatal("request from another IP rejected")
+	}
+}
+
+func TestControlLimiterGlobal(t *testing.T) {
+	l := newTestControlLimiter(t, 2, 5)
+	now := time.Now()
+	// 被单个IP的限速拦下的请求不消耗全局的令牌
+	flood := net.ParseIP("10.0.0.100")
+	for i := 0; i < 10; i++ {
+		l.allow(flood, now)
+	}
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow(net.IPv4(10, 0, 0, byte(i+1)), now); !allowed {
+			t.Fatalf("request from IP #%d rejected", i)
+		}
+	}
+	allowed, ipLimited := l.allow(net.ParseIP("10.0.0.200"), now)
+	if allowed || ipLimited {
+		t.Fatalf("6th request: allowed = %v, ipLimited = %v, want rejected by the global limit", allowed, ipLimited)
+	}
+}
+
+// 单独计数的IP达到上限后，新的IP不再加入map，只受全局限速约束
+func TestControlLimiterIPCap(t *testing.T) {
+	l := newTestControlLimiter(t, 1, 0)
+	now := time.Now()
+	for i := 0; i < maxControlIPs; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		if allowed, _ := l.allow(ip, now); !allowed {
+			t.Fatalf("first request from %v rejected", ip)
+		}
+	}
+	extra := net.ParseIP("192.168.0.1")
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow(extra, now); !allowed {
+			t.Fatalf("request #%d from an IP over the cap rejected", i)
+		}
+	}
+	if len(l.ips) != maxControlIPs {
+		t.Fatalf("tracked %d IPs, want %d", len(l.ips), maxControlIPs)
+	}
+	if _, exists := l.ips[extra.String()]; exists {
+		t.Fatal("IP over the cap tracked")
+	}
+}
+
+func TestControlLimiterClean(t *testing.T) {
+	l := newTestControlLimiter(t, 1, 0)
+	now := time.Now()
+	idle := net.ParseIP("10.0.0.1")
+	active := net.ParseIP("10.0.0.2")
+	l.allow(idle, now.Add(-controlIdleTime))
+	l.allow(active, now.Add(-controlIdleTime/2))
+	l.clean(now)
+	if _, exists := l.ips[idle.String()]; exists {
+		t.Fatal("idle IP not removed")
+	}
+	if _, exists := l.ips[active.String()]; !exists {
+		t.Fatal("active IP removed")
+	}
+	// 删除后重新计数，令牌桶是满的
+	if allowed, _ := l.allow(idle, now); !allowed {
+		t.Fatal("request from a cleaned IP rejected")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"relay/internal/conf"
+	"time"
+)
+
+// sessionTimeouts 为0的项表示不限制
+type sessionTimeouts struct {
+	idle        time.Duration // 两个方向都没有数据的最长时间
+	halfOpen    time.Duration // 创建之后还没有人加入的最长时间
+	maxDuration time.Duration // 从创建开始的最长时间
+	sweep       time.Duration // 检查超时的间隔
+	keepalive   time.Duration // relay主动探测RTT的间隔
+}
+
+func newSessionTimeouts() sessionTimeouts {
+	cfg := conf.Xml.Session
+	timeouts := sessionTimeouts{
+		idle:        time.Duration(cfg.IdleTimeout) * time.Second,
+		halfOpen:    time.Duration(cfg.HalfOpenTimeout) * time.Second,
+		maxDuration: time.Duration(cfg.MaxDuration) * time.Second,
+		sweep:       time.Duration(cfg.SweepInterval) * time.Second,
+		keepalive:   time.Duration(cfg.KeepaliveInterval) * time.Second,
+	}
+	if timeouts.idle <= 0 {
+		timeouts.idle = 30 * time.Second
+	}
+	if timeouts.sweep <= 0 {
+		timeouts.sweep = 5 * time.Second
+	}
+	return timeouts
+}
+
+// expire 返回session的过期时间和原因。lastActive一直在变，所以这只是当前的估计，
+// 到期时需要重新计算
+func (t *sessionTimeouts) expire(s *Session) (time.Time, string) {
+	expireAt := s.LastActiveTime().Add(t.idle)
+	reason := "idle"
+	if t.halfOpen > 0 && s.SecondAddr == nil {
+		if deadline := s.StartTime.Add(t.halfOpen); deadline.Before(expireAt) {
+			expireAt, reason = deadline, "not joined"
+		}
+	}
+	if t.maxDuration > 0 {
+		if deadline := s.StartTime.Add(t.maxDuration); deadline.Before(expireAt) {
+			expireAt, reason = deadline, "max duration reached"
+		}
+	}
+	return expireAt, reason
+}
+
+// expiryHeap 按Session.expireAt排序的最小堆，实现container/heap.Interface。
+// 清理时只需要检查堆顶已经到期的session，不用遍历所有session
+type expiryHeap []*Session
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].expireAt.Before(h[j].expireAt)
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	s := x.(*Session)
+	s.heapIndex = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.heapIndex = -1
+	*h = old[:n-1]
+	return s
+}
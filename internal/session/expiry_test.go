@@ -0,0 +1,138 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"container/heap"
+	"testing"
+	"time"
+
+	"relay/internal/conf"
+)
+
+// backdate 把session的创建时间和最后活动时间改到过去，并按新的时间调整在堆中的位置
+func backdate(mgr *SessionManager, s *Session, started time.Duration, active time.Duration) {
+	now := time.Now()
+	s.StartTime = now.Add(-started)
+	s.lastActive.Store(now.Add(-active).UnixNano())
+	s.expireAt, _ = mgr.timeouts.expire(s)
+	heap.Fix(&mgr.expiry, s.heapIndex)
+}
+
+func TestExpire(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts sessionTimeouts
+		joined   bool
+		started  time.Duration
+		active   time.Duration
+		expired  bool
+		reason   string
+	}{
+		{"idle", sessionTimeouts{idle: 30 * time.Second}, true, time.Hour, 40 * time.Second, true, "idle"},
+		{"active", sessionTimeouts{idle: 30 * time.Second}, true, time.Hour, 10 * time.Second, false, "idle"},
+		{"half open", sessionTimeouts{idle: 30 * time.Second, halfOpen: 10 * time.Second}, false, 20 * time.Second, 0, true, "not joined"},
+		{"joined", sessionTimeouts{idle: 30 * time.Second, halfOpen: 10 * time.Second}, true, 20 * time.Second, 0, false, "idle"},
+		{"max duration", sessionTimeouts{idle: 30 * time.Second, maxDuration: time.Minute}, true, 2 * time.Minute, 0, true, "max duration reached"},
+		{"unlimited duration", sessionTimeouts{idle: 30 * time.Second}, true, 24 * time.Hour, 0, false, "idle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			s := &Session{StartTime: now.Add(-tt.started)}
+			if tt.joined {
+				s.SecondAddr = testSecondAddr
+			}
+			s.lastActive.Store(now.Add(-tt.active).UnixNano())
+			expireAt, reason := tt.timeouts.expire(s)
+			if expired := !expireAt.After(now); expired != tt.expired || reason != tt.reason {
+				t.Fatalf("expired = %v (%s), want %v (%s)", expired, reason, tt.expired, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCleanSessions(t *testing.T) {
+	mgr := newTestManager()
+	mgr.timeouts = sessionTimeouts{idle: 30 * time.Second, halfOpen: 10 * time.Second, maxDuration: time.Hour}
+	idle := newTestRoom(t, mgr, 1000)
+	halfOpen := newHalfOpenRoom(t, mgr, 2000)
+	tooLong := newTestRoom(t, mgr, 3000)
+	fresh := newTestRoom(t, mgr, 4000)
+	backdate(mgr, idle, time.Hour, time.Minute)
+	backdate(mgr, halfOpen, 20*time.Second, 0)
+	backdate(mgr, tooLong, 2*time.Hour, 0)
+	mgr.cleanSessions()
+	if len(mgr.roomToSessions) != 1 || mgr.roomToSessions[fresh.Room.String()] != fresh {
+		t.Fatalf("%d rooms left, want only the fresh one", len(mgr.roomToSessions))
+	}
+	if len(mgr.addrToSessions) != 2 || len(mgr.expiry) != 1 {
+		t.Fatalf("%d addresses and %d heap entries left, want 2 and 1", len(mgr.addrToSessions), len(mgr.expiry))
+	}
+	if expired := mgr.stats.RoomsExpired.Load(); expired != 3 {
+		t.Fatalf("RoomsExpired = %d, want 3", expired)
+	}
+}
+
+// 堆中的过期时间只在创建和清理时计算，有数据时不更新。
+// 清理时堆顶的session如果又有了数据，要按新的过期时间放回堆中
+func TestExpiryHeapReorder(t *testing.T) {
+	old := conf.Xml
+	t.Cleanup(func() { conf.Xml = old })
+	mgr := newTestManager()
+	mgr.timeouts = sessionTimeouts{idle: 30 * time.Second}
+	a := newTestRoom(t, mgr, 1000)
+	b := newTestRoom(t, mgr, 2000)
+	backdate(mgr, a, time.Hour, 40*time.Second)
+	backdate(mgr, b, time.Hour, 20*time.Second)
+	if mgr.expiry[0] != a {
+		t.Fatal("room a should be at the top of the heap")
+	}
+	a.touch()
+	mgr.cleanSessions()
+	if len(mgr.roomToSessions) != 2 {
+		t.Fatalf("%d rooms left, want 2", len(mgr.roomToSessions))
+	}
+	if mgr.expiry[0] != b || mgr.expiry[1] != a || a.heapIndex != 1 || b.heapIndex != 0 {
+		t.Fatal("heap not reordered after room a became active")
+	}
+	if !a.expireAt.After(b.expireAt) {
+		t.Fatalf("a.expireAt = %v, want after %v", a.expireAt, b.expireAt)
+	}
+
+	// 重新加载缩短超时之后，所有过期时间重新计算
+	conf.Xml.Session.IdleTimeout = 10
+	mgr.Reload()
+	mgr.cleanSessions()
+	if len(mgr.roomToSessions) != 1 || mgr.roomToSessions[a.Room.String()] != a {
+		t.Fatal("shorter idle timeout should only remove room b")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"time"
+)
+
+const defaultReplayCacheSize = 10000
+
+type replayEntry struct {
+	key    string
+	expire time.Time
+}
+
+// replayCache 记录已经处理过的请求(ID+Integrity)，防止截获的请求被重放。
+// 所有记录的有效期相同，所以插入顺序就是过期顺序，超出容量时淘汰最早的记录
+type replayCache struct {
+	ttl     time.Duration
+	maxSize int
+	entries map[string]string // key -> 发送请求的地址
+	order   []replayEntry
+}
+
+func newReplayCache(ttl time.Duration, maxSize int) *replayCache {
+	if maxSize <= 0 {
+		maxSize = defaultReplayCacheSize
+	}
+	return &replayCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[string]string),
+	}
+}
+
+// resize 修改有效期和容量。缩短有效期后，已有记录仍按原来的时间过期
+func (c *replayCache) resize(ttl time.Duration, maxSize int) {
+	if maxSize <= 0 {
+		maxSize = defaultReplayCacheSize
+	}
+	c.ttl = ttl
+	c.maxSize = maxSize
+	for len(c.order) > c.maxSize {
+		delete(c.entries, c.order[0].key)
+		c.order = c.order[1:]
+	}
+}
+
+// seen 返回请求是否已经出现过，以及第一次出现时的来源地址
+func (c *replayCache) seen(id string, integrity string) (bool, string) {
+	c.expire(time.Now())
+	from, exists := c.entries[id+integrity]
+	return exists, from
+}
+
+// add 记录被接受的请求。被拒绝的请求不记录，客户端修正状态后重传不会被当成重放
+func (c *replayCache) add(id string, integrity string, addr string) {
+	now := time.Now()
+	c.expire(now)
+	key := id + integrity
+	if _, exists := c.entries[key]; exists {
+		return
+	}
+	if len(c.order) >= c.maxSize {
+		delete(c.entries, c.order[0].key)
+		c.order = c.order[1:]
+	}
+	c.entries[key] = addr
+	c.order = append(c.order, replayEntry{key: key, expire: now.Add(c.ttl)})
+}
+
+func (c *replayCache) expire(now time.Time) {
+	for len(c.order) != 0 && now.After(c.order[0].expire) {
+		delete(c.entries, c.order[0].key)
+		c.order = c.order[1:]
+	}
+}
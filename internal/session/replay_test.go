@@ -0,0 +1,145 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"relay/internal/msg"
+
+	"github.com/google/uuid"
+)
+
+func TestReplayCacheSeenAndAdd(t *testing.T) {
+	c := newReplayCache(time.Minute, 10)
+	if seen, _ := c.seen("id", "mac"); seen {
+		t.Fatal("empty cache reported a request as seen")
+	}
+	// seen只查询，不记录
+	if seen, _ := c.seen("id", "mac"); seen {
+		t.Fatal("seen recorded the request")
+	}
+	c.add("id", "mac", "1.1.1.1:1")
+	c.add("id", "mac", "2.2.2.2:2")
+	seen, from := c.seen("id", "mac")
+	if !seen || from != "1.1.1.1:1" {
+		t.Fatalf("seen = %v, %q, want true, first address", seen, from)
+	}
+	if seen, _ := c.seen("id", "other"); seen {
+		t.Fatal("different Integrity reported as seen")
+	}
+}
+
+func TestReplayCacheExpireAndEvict(t *testing.T) {
+	c := newReplayCache(time.Millisecond, 2)
+	c.add("a", "", "x")
+	time.Sleep(5 * time.Millisecond)
+	if seen, _ := c.seen("a", ""); seen {
+		t.Fatal("expired request reported as seen")
+	}
+	c = newReplayCache(time.Minute, 2)
+	c.add("a", "", "x")
+	c.add("b", "", "x")
+	c.add("c", "", "x")
+	if seen, _ := c.seen("a", ""); seen {
+		t.Fatal("oldest request was not evicted")
+	}
+	for _, id := range []string{"b", "c"} {
+		if seen, _ := c.seen(id, ""); !seen {
+			t.Fatalf("request %s was evicted", id)
+		}
+	}
+}
+
+// 被拒绝的请求不记录，room创建之后客户端重传同一个JoinRoomRequest仍然可以加入
+func TestJoinRetransmitAfterRoomInvalid(t *testing.T) {
+	mgr := newTestManager()
+	send, errCodes := captureErrCodes()
+	s := newHalfOpenRoom(t, mgr, 1000)
+	joiner := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+	join := joinRoomRequest(s.Room, "user2")
+	delete(mgr.roomToSessions, s.Room.String())
+	mgr.handleJoinRoomRequest(joiner, join, send)
+	mgr.roomToSessions[s.Room.String()] = s
+	mgr.handleJoinRoomRequest(joiner, join, send)
+	// 接受之后，同一请求从其他地址发来才是重放
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 3000}
+	mgr.handleJoinRoomRequest(other, join, send)
+	mgr.handleJoinRoomRequest(joiner, join, send)
+	want := []int32{msg.Err_RoomInvalid, msg.Err_OK, msg.Err_TimeInvalid, msg.Err_OK}
+	if !reflect.DeepEqual(*errCodes, want) {
+		t.Fatalf("JoinRoomResponse error codes = %v, want %v", *errCodes, want)
+	}
+	if !sameAddr(s.SecondAddr, joiner) {
+		t.Fatalf("SecondAddr = %v, want %v", s.SecondAddr, joiner)
+	}
+}
+
+func TestJoinTimeInvalid(t *testing.T) {
+	mgr := newTestManager()
+	send, errCodes := captureErrCodes()
+	s := newHalfOpenRoom(t, mgr, 1000)
+	joiner := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+	join := joinRoomRequest(s.Room, "user2")
+	stale := joinRoomRequestAt(s.Room, "user2", time.Now().Add(-time.Hour))
+	mgr.handleJoinRoomRequest(joiner, stale, send)
+	mgr.handleJoinRoomRequest(joiner, join, send)
+	want := []int32{msg.Err_TimeInvalid, msg.Err_OK}
+	if !reflect.DeepEqual(*errCodes, want) {
+		t.Fatalf("JoinRoomResponse error codes = %v, want %v", *errCodes, want)
+	}
+}
+
+// 被拒绝的LeaveRoomRequest不记录；room关闭之后同一地址的重传仍然回复成功
+func TestLeaveRetransmit(t *testing.T) {
+	mgr := newTestManager()
+	s := newHalfOpenRoom(t, mgr, 1000)
+	leave := &msg.LeaveRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: "user1", Room: uuid.New(), Integrity: "l"}
+	if _, errCode := mgr.leaveRoom(s.FirstAddr, leave); errCode != msg.Err_RoomInvalid {
+		t.Fatalf("leaveRoom with unknown room = %d, want Err_RoomInvalid", errCode)
+	}
+	leave.Room = s.Room
+	for i := 0; i < 2; i++ {
+		if _, errCode := mgr.leaveRoom(s.FirstAddr, leave); errCode != msg.Err_OK {
+			t.Fatalf("leaveRoom #%d = %d, want Err_OK", i, errCode)
+		}
+	}
+	if len(mgr.roomToSessions) != 0 || len(mgr.addrToSessions) != 0 {
+		t.Fatal("room not closed")
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 3000}
+	if _, errCode := mgr.leaveRoom(other, leave); errCode != msg.Err_TimeInvalid {
+		t.Fatalf("replayed leaveRoom = %d, want Err_TimeInvalid", errCode)
+	}
+}
@@ -32,29 +32,182 @@ package session
 
 import (
 	"net"
+	"relay/internal/ratelimit"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
+// Session 的地址和限速配置只在SessionManager持有写锁时修改，
+// 转发数据时持有读锁，可能被多个worker同时访问
 type Session struct {
+	Room       uuid.UUID
+	Username   string
+	FirstAddr  *net.UDPAddr //向relay服务器申请room的地址
+	SecondAddr *net.UDPAddr //向relay服务器加入room的地址
+	StartTime  time.Time
+	// 双方的协议版本和加入方的用户名，通知对端时使用
+	firstVersion   uint32
+	secondVersion  uint32
+	secondUsername string
+	firstToken     string // 双方的session token，RebindRequest用来确定是哪一方换了地址，VersionTwo的一方为空
+	secondToken    string
+	lastActive     atomic.Int64 // UnixNano
+	firstRTT       atomic.Int64 // time.Duration，0表示还没有测量到
+	secondRTT      atomic.Int64
+	policy         *limitPolicy
+	reqToResp      relayDirection // FirstAddr -> SecondAddr
+	respToReq      relayDirection // SecondAddr -> FirstAddr
+	expireAt       time.Time      // 在expiryHeap中的排序依据
+	heapIndex      int
+}
+
+// SessionInfo Session的快照，可以交给其他goroutine使用
+type SessionInfo struct {
 	Room           uuid.UUID
-	FirstAddr      *net.UDPAddr //向relay服务器申请room的地址
-	SecondAddr     *net.UDPAddr //向relay服务器加入room的地址
+	Username       string
+	FirstAddr      *net.UDPAddr
+	SecondAddr     *net.UDPAddr
+	StartTime      time.Time
 	LastActiveTime time.Time
-	sendMessage    SendFunc
+	FirstRTT       time.Duration // relay到FirstAddr的往返时间，0表示未知
+	SecondRTT      time.Duration
+	ReqToResp      TrafficStats
+	RespToReq      TrafficStats
 }
 
-func (s *Session) RelayPacket(addr *net.UDPAddr, data []byte) {
-	// TODO: 限速
-	if addr.String() == s.FirstAddr.String() {
+// relayDirection 单个转发方向的限速状态和流量计数
+type relayDirection struct {
+	mutex      sync.Mutex        // 保护queue，同时保证同一方向的包按顺序发出
+	bucket     *ratelimit.Bucket // session级别
+	userBucket *ratelimit.Bucket // 用户级别，同一用户的所有session共用
+	queue      [][]byte
+	counter    trafficCounter
+	total      *trafficCounter // 全局计数
+}
+
+func (s *Session) RelayPacket(addr *net.UDPAddr, data []byte, send SendFunc) {
+	if sameAddr(addr, s.FirstAddr) {
 		logrus.Debug("Relay message to SecondAddr")
-		s.sendMessage(s.SecondAddr, data)
-	} else if addr.String() == s.SecondAddr.String() {
+		s.relay(&s.reqToResp, s.SecondAddr, data, send)
+	} else if sameAddr(addr, s.SecondAddr) {
 		logrus.Debug("Relay message to FirstAddr")
-		s.sendMessage(s.FirstAddr, data)
+		s.relay(&s.respToReq, s.FirstAddr, data, send)
 	} else {
 		logrus.Debugf("Room(%s) recieved relay message from unknown address(%s)", s.Room, addr.String())
 	}
 }
+
+func (s *Session) relay(d *relayDirection, to *net.UDPAddr, data []byte, send SendFunc) {
+	if to == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// 已经有包在排队时，新包必须排在后面，否则会乱序
+	if len(d.queue) == 0 && d.allow(len(data)) {
+		d.send(send, to, data)
+		return
+	}
+	if !s.policy.queue || len(d.queue) >= s.policy.queueSize {
+		d.counter.addDropped(len(data))
+		d.total.addDropped(len(data))
+		return
+	}
+	// data属于收包缓冲区，排队必须拷贝
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	d.queue = append(d.queue, packet)
+}
+
+// flush 按令牌发送排队中的包
+func (s *Session) flush(send SendFunc) {
+	s.flushDirection(&s.reqToResp, s.SecondAddr, send)
+	s.flushDirection(&s.respToReq, s.FirstAddr, send)
+}
+
+func (s *Session) flushDirection(d *relayDirection, to *net.UDPAddr, send SendFunc) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for len(d.queue) != 0 && d.allow(len(d.queue[0])) {
+		d.send(send, to, d.queue[0])
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+	}
+}
+
+func (s *Session) hasQueued() bool {
+	return s.reqToResp.queued() || s.respToReq.queued()
+}
+
+func (s *Session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *Session) LastActiveTime() time.Time {
+	return time.Unix(0, s.lastActive.Load())
+}
+
+// updateRTT 记录addr一方的往返时间，可以在持有读锁时调用
+func (s *Session) updateRTT(addr *net.UDPAddr, rtt time.Duration) {
+	if sameAddr(addr, s.FirstAddr) {
+		s.firstRTT.Store(int64(rtt))
+	} else if sameAddr(addr, s.SecondAddr) {
+		s.secondRTT.Store(int64(rtt))
+	}
+}
+
+// Traffic 返回两个方向的流量计数，可以在任意goroutine中调用
+func (s *Session) Traffic() (reqToResp TrafficStats, respToReq TrafficStats) {
+	return s.reqToResp.counter.snapshot(), s.respToReq.counter.snapshot()
+}
+
+func (s *Session) info() SessionInfo {
+	reqToResp, respToReq := s.Traffic()
+	return SessionInfo{
+		Room:           s.Room,
+		Username:       s.Username,
+		FirstAddr:      s.FirstAddr,
+		SecondAddr:     s.SecondAddr,
+		StartTime:      s.StartTime,
+		LastActiveTime: s.LastActiveTime(),
+		FirstRTT:       time.Duration(s.firstRTT.Load()),
+		SecondRTT:      time.Duration(s.secondRTT.Load()),
+		ReqToResp:      reqToResp,
+		RespToReq:      respToReq,
+	}
+}
+
+func (d *relayDirection) send(send SendFunc, to *net.UDPAddr, data []byte) {
+	send(to, data)
+	d.counter.addRelayed(len(data))
+	d.total.addRelayed(len(data))
+}
+
+func (d *relayDirection) queued() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.queue) != 0
+}
+
+func (d *relayDirection) allow(n int) bool {
+	if !d.bucket.Allow(n) {
+		return false
+	}
+	if !d.userBucket.Allow(n) {
+		d.bucket.Refund(n)
+		return false
+	}
+	return true
+}
+
+// sameAddr 比较两个地址是否相同，兼容IPv4-mapped IPv6地址
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
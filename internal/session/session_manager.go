@@ -31,10 +31,20 @@
 package session
 
 import (
+	"container/heap"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
 	"net"
 	"relay/internal/auth"
+	"relay/internal/common"
 	"relay/internal/conf"
 	"relay/internal/msg"
+	"relay/internal/ratelimit"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -43,91 +53,592 @@ import (
 
 type SendFunc func(addr *net.UDPAddr, data []byte)
 
+// SessionManager 的导出方法都可以在任意goroutine中调用。
+// 多个worker同时调用HandlePacket时，转发数据只需要读锁，
+// 创建、加入、删除room需要写锁
 type SessionManager struct {
+	mutex          sync.RWMutex
 	addrToSessions map[string]*Session
 	roomToSessions map[string]*Session
-	sendMessage    SendFunc
+	userLimiters   map[string]*userLimiter
+	blockedUsers   map[string]time.Time // 被管理员禁止创建room的用户，值为解禁时间
+	bans           *banList
+	controlLimiter *controlLimiter
+	access         *accessControl
+	replays        *replayCache
+	queueMutex     sync.Mutex            // 保护queuedSessions，需要在mutex之后加锁
+	queuedSessions map[*Session]struct{} // 有包在限速队列中的session
+	queuedCount    atomic.Int64
+	policy         *limitPolicy
+	timeouts       sessionTimeouts
+	sweepInterval  atomic.Int64 // time.Duration，在锁外读取
+	keepalive      atomic.Int64 // time.Duration，0表示不主动探测
+	expiry         expiryHeap
+	stats          *Stats
 	authenticator  auth.Authenticator
-	lastClenupTime time.Time
+	lastClenupTime atomic.Int64 // UnixNano
+	lastProbeTime  atomic.Int64 // UnixNano
+	probeMutex     sync.Mutex
+	probes         map[string]pendingProbe // relay发出、还没有收到回复的探测，key为ID
+	draining       atomic.Bool             // 正在关闭，拒绝创建新的room
 }
 
-func NewManager() *SessionManager {
-	var authenticator auth.Authenticator
-	if conf.Xml.Auth.UseDB {
-		authenticator = auth.NewDBAuthenticator(conf.Xml.Auth.DB)
-	} else {
-		authenticator = auth.NewXmlAuthenticator()
+// limitPolicy 限速配置，速率已换算成字节/秒
+type limitPolicy struct {
+	queue            bool
+	queueSize        int
+	sessionReqToResp uint64
+	sessionRespToReq uint64
+	userReqToResp    uint64
+	userRespToReq    uint64
+}
+
+// userLimiter 同一用户所有session共用的令牌桶
+type userLimiter struct {
+	reqToResp *ratelimit.Bucket
+	respToReq *ratelimit.Bucket
+	refs      int
+}
+
+func newLimitPolicy() *limitPolicy {
+	cfg := conf.Xml.RateLimit
+	policy := &limitPolicy{
+		queueSize:        cfg.QueueSize,
+		sessionReqToResp: ratelimit.KbpsToBytes(cfg.SessionReqToResp),
+		sessionRespToReq: ratelimit.KbpsToBytes(cfg.SessionRespToReq),
+		userReqToResp:    ratelimit.KbpsToBytes(cfg.UserReqToResp),
+		userRespToReq:    ratelimit.KbpsToBytes(cfg.UserRespToReq),
+	}
+	switch strings.ToLower(cfg.Policy) {
+	case "queue":
+		policy.queue = true
+	case "", "drop":
+	default:
+		logrus.Warnf("Unknown ratelimit policy(%s), default to drop", cfg.Policy)
 	}
+	if policy.queue && policy.queueSize <= 0 {
+		policy.queueSize = 256
+	}
+	return policy
+}
+
+// newBucket 容量取200ms的流量
+func newBucket(rate uint64) *ratelimit.Bucket {
+	return ratelimit.NewBucket(rate, rate/5)
+}
 
+func NewManager() *SessionManager {
+	authenticator := auth.New()
 	if authenticator == nil {
 		return nil
 	}
-	return &SessionManager{
+	maxTimeSkew := time.Duration(conf.Xml.Auth.MaxTimeSkew) * time.Second
+	mgr := &SessionManager{
 		addrToSessions: make(map[string]*Session),
 		roomToSessions: make(map[string]*Session),
+		userLimiters:   make(map[string]*userLimiter),
+		queuedSessions: make(map[*Session]struct{}),
+		blockedUsers:   make(map[string]time.Time),
+		probes:         make(map[string]pendingProbe),
+		bans:           newBanList(),
+		controlLimiter: newControlLimiter(),
+		access:         newAccessControl(),
+		replays:        newReplayCache(replayTTL(maxTimeSkew), conf.Xml.Auth.ReplayCacheSize),
+		policy:         newLimitPolicy(),
+		timeouts:       newSessionTimeouts(),
+		stats:          newStats(),
 		authenticator:  authenticator,
-		lastClenupTime: time.Now(),
 	}
+	mgr.sweepInterval.Store(int64(mgr.timeouts.sweep))
+	mgr.keepalive.Store(int64(mgr.timeouts.keepalive))
+	mgr.lastClenupTime.Store(time.Now().UnixNano())
+	mgr.lastProbeTime.Store(time.Now().UnixNano())
+	return mgr
+}
+
+// Reload 按conf.Xml重新加载验证、防重放、封禁、网段限制、控制消息限速和带宽限速配置。
+// 已有的session保持不变，新的限速立即对它们生效
+func (mgr *SessionManager) Reload() {
+	mgr.authenticator.Reload()
+	maxTimeSkew := time.Duration(conf.Xml.Auth.MaxTimeSkew) * time.Second
+	mgr.bans.load()
+	mgr.controlLimiter.load()
+	mgr.access.load()
+	policy := newLimitPolicy()
+	// 用户级别的限速可能需要查询数据库，先在锁外查好
+	mgr.mutex.RLock()
+	usernames := make([]string, 0, len(mgr.userLimiters))
+	for username := range mgr.userLimiters {
+		usernames = append(usernames, username)
+	}
+	mgr.mutex.RUnlock()
+	limits := make(map[string]auth.Limit, len(usernames))
+	for _, username := range usernames {
+		limits[username] = mgr.authenticator.Limit(username)
+	}
+
+	// 持有写锁时没有worker在转发数据，可以直接替换session的令牌桶
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.replays.resize(replayTTL(maxTimeSkew), conf.Xml.Auth.ReplayCacheSize)
+	mgr.timeouts = newSessionTimeouts()
+	mgr.sweepInterval.Store(int64(mgr.timeouts.sweep))
+	mgr.keepalive.Store(int64(mgr.timeouts.keepalive))
+	for _, s := range mgr.expiry {
+		s.expireAt, _ = mgr.timeouts.expire(s)
+	}
+	heap.Init(&mgr.expiry)
+	mgr.policy = policy
+	for username, limiter := range mgr.userLimiters {
+		limit, exists := limits[username]
+		if !exists {
+			// 在查询期间才创建的limiter，已经使用了最新的用户限速
+			continue
+		}
+		limiter.reqToResp, limiter.respToReq = mgr.newUserBuckets(limit)
+	}
+	for _, s := range mgr.roomToSessions {
+		limiter := mgr.userLimiters[s.Username]
+		s.policy = policy
+		s.reqToResp.bucket = newBucket(policy.sessionReqToResp)
+		s.reqToResp.userBucket = limiter.reqToResp
+		s.respToReq.bucket = newBucket(policy.sessionRespToReq)
+		s.respToReq.userBucket = limiter.respToReq
+	}
+	logrus.Infof("SessionManager reloaded, %d rooms updated", len(mgr.roomToSessions))
+}
+
+// Stats 返回全局计数，可以在任意goroutine中读取
+func (mgr *SessionManager) Stats() *Stats {
+	return mgr.stats
+}
+
+// Sessions 返回当前所有session的快照
+func (mgr *SessionManager) Sessions() []SessionInfo {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	infos := make([]SessionInfo, 0, len(mgr.roomToSessions))
+	for _, s := range mgr.roomToSessions {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// Drain 开始关闭，之后的CreateRoomRequest都会被拒绝，已有的room可以继续加入和转发
+func (mgr *SessionManager) Drain() {
+	mgr.draining.Store(true)
+}
+
+// RoomCounts 返回当前room数量，以及其中还没有人加入的数量
+func (mgr *SessionManager) RoomCounts() (rooms int, halfOpen int) {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	for _, s := range mgr.roomToSessions {
+		if s.SecondAddr == nil {
+			halfOpen++
+		}
+	}
+	return len(mgr.roomToSessions), halfOpen
+}
+
+// CloseRoom 关闭指定room，返回room是否存在
+func (mgr *SessionManager) CloseRoom(room uuid.UUID) bool {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	s, exists := mgr.roomToSessions[room.String()]
+	if !exists {
+		return false
+	}
+	logrus.Infof("Closing room %s by admin", room)
+	mgr.removeSession(s)
+	mgr.stats.RoomsClosed.Add(1)
+	return true
+}
+
+// CloseAddr 关闭指定地址所在的room，返回room是否存在
+func (mgr *SessionManager) CloseAddr(addr *net.UDPAddr) bool {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	s, exists := mgr.addrToSessions[addr.String()]
+	if !exists {
+		return false
+	}
+	logrus.Infof("Closing room %s of address %s by admin", s.Room, addr.String())
+	mgr.removeSession(s)
+	mgr.stats.RoomsClosed.Add(1)
+	return true
+}
+
+// CloseUser 关闭用户创建或加入的所有room，blockFor大于0时，在这段时间内拒绝该用户创建或加入room。
+// 返回关闭的room数量
+func (mgr *SessionManager) CloseUser(username string, blockFor time.Duration) int {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if blockFor > 0 {
+		logrus.Infof("Blocking user %s for %v by admin", username, blockFor)
+		mgr.blockedUsers[username] = time.Now().Add(blockFor)
+	}
+	count := 0
+	for _, s := range mgr.roomToSessions {
+		if s.Username == username || s.secondUsername == username {
+			logrus.Infof("Closing room %s of user %s by admin", s.Room, username)
+			mgr.removeSession(s)
+			mgr.stats.RoomsClosed.Add(1)
+			count++
+		}
+	}
+	return count
+}
+
+// Bans 返回当前生效的封禁
+func (mgr *SessionManager) Bans() []BanInfo {
+	return mgr.bans.list(time.Now())
+}
+
+// LiftIPBan 解除对IP的封禁，返回该IP是否处于封禁中
+func (mgr *SessionManager) LiftIPBan(ip net.IP) bool {
+	return mgr.bans.lift(BanKindIP, ip.String())
+}
+
+// LiftUserBan 解除对用户名的封禁，返回该用户是否处于封禁中
+func (mgr *SessionManager) LiftUserBan(username string) bool {
+	return mgr.bans.lift(BanKindUser, username)
+}
+
+// replayTTL 请求时间与服务器时间相差maxTimeSkew以内都会被接受，
+// 所以防重放记录至少要保存2*maxTimeSkew
+func replayTTL(maxTimeSkew time.Duration) time.Duration {
+	if maxTimeSkew <= 0 {
+		return time.Minute
+	}
+	return 2 * maxTimeSkew
+}
+
+// isReplay 判断已通过验证的请求是否是重放的。
+// 客户端从同一地址重传请求，且原来的session仍然存在时，不算重放
+func (mgr *SessionManager) isReplay(addr *net.UDPAddr, id string, integrity string) bool {
+	seen, from := mgr.replays.seen(id, integrity)
+	if !seen {
+		return false
+	}
+	_, exists := mgr.addrToSessions[addr.String()]
+	return from != addr.String() || !exists
 }
 
-func (mgr *SessionManager) SetSendFunc(sendFunc SendFunc) {
-	mgr.sendMessage = sendFunc
+func (mgr *SessionManager) isBlocked(username string) bool {
+	until, exists := mgr.blockedUsers[username]
+	return exists && time.Now().Before(until)
 }
 
-func (mgr *SessionManager) HandlePacket(addr *net.UDPAddr, data []byte) {
+// authFailed 记录验证失败。签名、地址和时间错误计入来源IP的封禁统计，countUser为true时
+// 同时计入用户名，见auth.Result.CountUser；room不存在之类的错误可能只是客户端状态过时，不计入
+func (mgr *SessionManager) authFailed(addr *net.UDPAddr, username string, errCode int32, countUser bool) {
+	mgr.stats.addAuthFailure(errCode)
+	if !countUser {
+		username = ""
+	}
+	switch errCode {
+	case msg.Err_AuthFailed, msg.Err_AddressInvalid, msg.Err_TimeInvalid:
+		mgr.stats.Bans.Add(uint64(mgr.bans.fail(addr.IP, username, time.Now())))
+	}
+}
+
+// isBanned 被封禁的来源直接丢弃请求，不回复也不查询用户，避免给攻击者反馈和增加数据库压力
+func (mgr *SessionManager) isBanned(addr *net.UDPAddr, username string, msgName string) bool {
+	if !mgr.bans.isBanned(addr.IP, username, time.Now()) {
+		return false
+	}
+	logrus.Debugf("Dropped %s(user:%s) from banned %s", msgName, username, addr.String())
+	mgr.stats.BannedRequests.Add(1)
+	return true
+}
+
+func (mgr *SessionManager) HandlePacket(addr *net.UDPAddr, data []byte, send SendFunc) {
 	msgType := msg.MessageType(data)
+	mgr.stats.addControlPacket(msgType)
+	if msgType == msg.TypeUnknown || mgr.allowControl(addr) {
+		mgr.handleMessage(addr, data, msgType, send)
+	}
+	mgr.flushQueues(send)
+	mgr.maybeCleanSessions()
+	mgr.maybeProbeSessions(send)
+}
+
+// allowControl 超过控制消息限速时静默丢弃，不解析也不回复，
+// 避免relay被用来放大反射流量，也避免洪水拖垮验证和数据库
+func (mgr *SessionManager) allowControl(addr *net.UDPAddr) bool {
+	allowed, ipLimited := mgr.controlLimiter.allow(addr.IP, time.Now())
+	if allowed {
+		return true
+	}
+	if ipLimited {
+		mgr.stats.IPLimited.Add(1)
+	} else {
+		mgr.stats.GlobalLimited.Add(1)
+	}
+	return false
+}
+
+func (mgr *SessionManager) handleMessage(addr *net.UDPAddr, data []byte, msgType uint32, send SendFunc) {
 	switch msgType {
 	case msg.TypeCreateRoomRequest:
-		mgr.handleCreateRoomRequest(addr, data)
+		mgr.handleCreateRoomRequest(addr, data, send)
 	case msg.TypeJoinRoomRequest:
-		mgr.handleJoinRoomRequest(addr, data)
+		mgr.handleJoinRoomRequest(addr, data, send)
+	case msg.TypeLeaveRoomRequest:
+		mgr.handleLeaveRoomRequest(addr, data, send)
+	case msg.TypeRebindRequest:
+		mgr.handleRebindRequest(addr, data, send)
+	case msg.TypeKeepaliveRequest:
+		mgr.handleKeepaliveRequest(addr, data, send)
+	case msg.TypeKeepaliveResponse:
+		mgr.handleKeepaliveResponse(addr, data)
 	case msg.TypeReflexRequest:
-		mgr.handleReflexRequest(addr, data)
+		mgr.handleReflexRequest(addr, data, send)
 	case msg.TypeUnknown:
 		fallthrough
 	default:
-		mgr.handleUnknownPacket(addr, data)
+		mgr.handleUnknownPacket(addr, data, send)
 	}
-	mgr.maybeCleanSessions()
 }
 
-func (mgr *SessionManager) HandleIdle() {
+func (mgr *SessionManager) HandleIdle(send SendFunc) {
+	mgr.flushQueues(send)
 	mgr.maybeCleanSessions()
+	mgr.maybeProbeSessions(send)
+}
+
+func (mgr *SessionManager) flushQueues(send SendFunc) {
+	if mgr.queuedCount.Load() == 0 {
+		return
+	}
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	mgr.queueMutex.Lock()
+	defer mgr.queueMutex.Unlock()
+	for s := range mgr.queuedSessions {
+		s.flush(send)
+		if !s.hasQueued() {
+			delete(mgr.queuedSessions, s)
+			mgr.queuedCount.Add(-1)
+		}
+	}
+}
+
+func (mgr *SessionManager) markQueued(s *Session) {
+	mgr.queueMutex.Lock()
+	defer mgr.queueMutex.Unlock()
+	if _, exists := mgr.queuedSessions[s]; !exists {
+		mgr.queuedSessions[s] = struct{}{}
+		mgr.queuedCount.Add(1)
+	}
 }
 
+// maybeCleanSessions 多个worker同时到期时，只有一个会执行清理
 func (mgr *SessionManager) maybeCleanSessions() {
+	now := time.Now().UnixNano()
+	last := mgr.lastClenupTime.Load()
+	if now-last < mgr.sweepInterval.Load() || !mgr.lastClenupTime.CompareAndSwap(last, now) {
+		return
+	}
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.cleanSessions()
+}
+
+// maybeProbeSessions 与maybeCleanSessions一样只由一个worker执行，探测只读session，持有读锁即可
+func (mgr *SessionManager) maybeProbeSessions(send SendFunc) {
+	interval := mgr.keepalive.Load()
+	if interval <= 0 {
+		return
+	}
 	now := time.Now()
-	if mgr.lastClenupTime.Add(time.Second * 5).Before(now) {
-		mgr.lastClenupTime = now
-		mgr.cleanSessions()
+	last := mgr.lastProbeTime.Load()
+	if now.UnixNano()-last < interval || !mgr.lastProbeTime.CompareAndSwap(last, now.UnixNano()) {
+		return
 	}
+	mgr.probeMutex.Lock()
+	for id, probe := range mgr.probes {
+		if now.Sub(probe.sentAt) > maxProbeAge {
+			delete(mgr.probes, id)
+		}
+	}
+	mgr.probeMutex.Unlock()
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	for _, s := range mgr.roomToSessions {
+		// VersionTwo的客户端不认识KeepaliveRequest，会把它当成对端的数据
+		if s.firstVersion != msg.VersionTwo {
+			mgr.probe(s.FirstAddr, s.firstVersion, s.Room, now, send)
+		}
+		if s.SecondAddr != nil && s.secondVersion != msg.VersionTwo {
+			mgr.probe(s.SecondAddr, s.secondVersion, s.Room, now, send)
+		}
+	}
+}
+
+// pendingProbe relay发出的KeepaliveRequest，收到回复时用sentAt计算RTT
+type pendingProbe struct {
+	addr   *net.UDPAddr
+	room   uuid.UUID
+	sentAt time.Time
+}
+
+// maxProbeAge 超过这个时间还没有回复的探测视为丢失
+const maxProbeAge = time.Minute
+
+// probe 记录发送时间后发出探测。RTT只按relay自己记录的时间计算，
+// 客户端带回的Time不可信
+func (mgr *SessionManager) probe(addr *net.UDPAddr, version uint32, room uuid.UUID, now time.Time, send SendFunc) {
+	// ID不可预测，伪造客户端地址的回复无法冒充探测结果
+	id := randomID()
+	mgr.probeMutex.Lock()
+	mgr.probes[id] = pendingProbe{addr: addr, room: room, sentAt: now}
+	mgr.probeMutex.Unlock()
+	send(addr, msg.NewKeepaliveRequest(version, id, room, now).ToBytes())
+}
+
+// randomID 用作探测ID和session token。两个字段都是16字节，session token在回复中
+// 还按C字符串解析，所以用8字节crypto/rand随机数的hex形式
+func randomID() string {
+	buffer := make([]byte, common.Fixed16/2)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(buffer)
 }
 
 func (mgr *SessionManager) cleanSessions() {
-	timeout := time.Second * 30
+	mgr.stats.Sweeps.Add(1)
 	now := time.Now()
-	for roomStr, s := range mgr.roomToSessions {
-		if s.LastActiveTime.Add(timeout).Before(now) {
-			logrus.Infof("Removing room %s", roomStr)
-			delete(mgr.addrToSessions, s.FirstAddr.String())
-			delete(mgr.addrToSessions, s.SecondAddr.String())
-			delete(mgr.roomToSessions, roomStr)
+	for len(mgr.expiry) != 0 && !mgr.expiry[0].expireAt.After(now) {
+		s := mgr.expiry[0]
+		expireAt, reason := mgr.timeouts.expire(s)
+		if expireAt.After(now) {
+			// 期间有数据或者有人加入，按新的过期时间放回堆中
+			s.expireAt = expireAt
+			heap.Fix(&mgr.expiry, 0)
+			continue
+		}
+		logrus.Infof("Removing room %s: %s", s.Room, reason)
+		mgr.removeSession(s)
+		mgr.stats.RoomsExpired.Add(1)
+	}
+	for username, until := range mgr.blockedUsers {
+		if !now.Before(until) {
+			delete(mgr.blockedUsers, username)
 		}
 	}
+	mgr.bans.clean(now)
+	mgr.controlLimiter.clean(now)
+}
+
+func (mgr *SessionManager) removeSession(s *Session) {
+	reqToResp, respToReq := s.Traffic()
+	logrus.Infof("Room %s lasted %v, relayed %d/%d bytes, dropped %d/%d bytes by ratelimit (req_to_resp/resp_to_req)",
+		s.Room, time.Since(s.StartTime).Round(time.Second), reqToResp.Bytes, respToReq.Bytes, reqToResp.DroppedBytes, respToReq.DroppedBytes)
+	delete(mgr.addrToSessions, s.FirstAddr.String())
+	if s.SecondAddr != nil {
+		delete(mgr.addrToSessions, s.SecondAddr.String())
+	}
+	delete(mgr.roomToSessions, s.Room.String())
+	heap.Remove(&mgr.expiry, s.heapIndex)
+	mgr.queueMutex.Lock()
+	if _, exists := mgr.queuedSessions[s]; exists {
+		delete(mgr.queuedSessions, s)
+		mgr.queuedCount.Add(-1)
+	}
+	mgr.queueMutex.Unlock()
+	mgr.releaseUserLimiter(s.Username)
+	mgr.stats.RoomsRemoved.Add(1)
+	mgr.stats.SessionDuration.observe(time.Since(s.StartTime))
+}
+
+// acquireUserLimiter limit由调用者在锁外查询，避免持锁访问数据库
+func (mgr *SessionManager) acquireUserLimiter(username string, limit auth.Limit) *userLimiter {
+	limiter, exists := mgr.userLimiters[username]
+	if !exists {
+		limiter = &userLimiter{}
+		limiter.reqToResp, limiter.respToReq = mgr.newUserBuckets(limit)
+		mgr.userLimiters[username] = limiter
+	}
+	limiter.refs++
+	return limiter
+}
+
+// newUserBuckets 用户单独配置的限速覆盖全局配置
+func (mgr *SessionManager) newUserBuckets(limit auth.Limit) (*ratelimit.Bucket, *ratelimit.Bucket) {
+	reqToResp := mgr.policy.userReqToResp
+	respToReq := mgr.policy.userRespToReq
+	if limit.ReqToResp != 0 {
+		reqToResp = ratelimit.KbpsToBytes(limit.ReqToResp)
+	}
+	if limit.RespToReq != 0 {
+		respToReq = ratelimit.KbpsToBytes(limit.RespToReq)
+	}
+	return newBucket(reqToResp), newBucket(respToReq)
+}
+
+func (mgr *SessionManager) releaseUserLimiter(username string) {
+	limiter, exists := mgr.userLimiters[username]
+	if !exists {
+		return
+	}
+	limiter.refs--
+	if limiter.refs <= 0 {
+		delete(mgr.userLimiters, username)
+	}
 }
 
-func (mgr *SessionManager) handleCreateRoomRequest(addr *net.UDPAddr, data []byte) {
+func (mgr *SessionManager) handleCreateRoomRequest(addr *net.UDPAddr, data []byte, send SendFunc) {
 	request := msg.ParseCreateRoomRequest(data)
 	if request == nil {
 		logrus.Debugf("ParseCreateRoomRequest failed")
+		mgr.stats.InvalidPackets.Add(1)
+		return
+	}
+	if mgr.isBanned(addr, request.Username, "CreateRoomRequest") {
+		return
+	}
+	if mgr.draining.Load() {
+		logrus.Debugf("Rejected CreateRoomRequest(user:%s) from %s while draining", request.Username, addr.String())
+		mgr.sendCreateRoomResponse(addr, request, "", msg.Err_Unavailable, uuid.UUID{}, "", send)
+		return
+	}
+	// 验证可能需要查询数据库，不能持锁进行
+	result := mgr.authenticator.Auth(addr, request, data[:msg.BaseMessageSize-msg.IntegritySize])
+	errCode := result.ErrCode
+	if errCode == msg.Err_OK {
+		errCode = mgr.checkUserAddr(addr, request.Username)
+	}
+	if errCode != msg.Err_OK {
+		mgr.authFailed(addr, request.Username, errCode, result.CountUser)
+		mgr.sendCreateRoomResponse(addr, request, result.Key, errCode, uuid.UUID{}, "", send)
 		return
 	}
-	errCode := mgr.authenticator.Auth(addr, request, data[:msg.BaseMessageSize-msg.IntegritySize])
+	limit := mgr.authenticator.Limit(request.Username)
+	room, token, errCode := mgr.createRoom(addr, request, limit)
 	if errCode != msg.Err_OK {
-		response := msg.NewCreateRoomResponse(request.ID, errCode, [16]byte{})
-		mgr.sendMessage(addr, response.ToBytes())
+		mgr.sendCreateRoomResponse(addr, request, result.Key, errCode, uuid.UUID{}, "", send)
 		return
 	}
+	logrus.Infof("Send CreateRoomResponse(%s) to %s", room.String(), addr.String())
+	mgr.sendCreateRoomResponse(addr, request, result.Key, msg.Err_OK, room, token, send)
+}
+
+// createRoom 持锁完成验证之后的检查，并创建session。同一地址重复请求时返回原来的room和session token
+func (mgr *SessionManager) createRoom(addr *net.UDPAddr, request *msg.CreateRoomRequest, limit auth.Limit) (uuid.UUID, string, int32) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if mgr.isBlocked(request.Username) {
+		logrus.Infof("Rejected CreateRoomRequest from blocked user %s", request.Username)
+		return uuid.UUID{}, "", msg.Err_AuthFailed
+	}
+	if mgr.isReplay(addr, request.ID, request.Integrity) {
+		logrus.Warnf("CreateRoomRequest(user:%s) from %s replayed", request.Username, addr.String())
+		mgr.authFailed(addr, request.Username, msg.Err_TimeInvalid, false)
+		return uuid.UUID{}, "", msg.Err_TimeInvalid
+	}
 	s, exists := mgr.addrToSessions[addr.String()]
 	if !exists {
 		var roomUUID uuid.UUID
@@ -140,59 +651,383 @@ func (mgr *SessionManager) handleCreateRoomRequest(addr *net.UDPAddr, data []byt
 			}
 			break
 		}
+		limiter := mgr.acquireUserLimiter(request.Username, limit)
 		s = &Session{
-			Room:        roomUUID,
-			FirstAddr:   addr,
-			sendMessage: mgr.sendMessage,
+			Room:         roomUUID,
+			Username:     request.Username,
+			FirstAddr:    addr,
+			StartTime:    time.Now(),
+			policy:       mgr.policy,
+			firstVersion: request.Version,
+			firstToken:   newSessionToken(request.Version),
+			reqToResp: relayDirection{
+				bucket:     newBucket(mgr.policy.sessionReqToResp),
+				userBucket: limiter.reqToResp,
+				total:      &mgr.stats.ReqToResp,
+			},
+			respToReq: relayDirection{
+				bucket:     newBucket(mgr.policy.sessionRespToReq),
+				userBucket: limiter.respToReq,
+				total:      &mgr.stats.RespToReq,
+			},
 		}
+		s.touch()
+		s.expireAt, _ = mgr.timeouts.expire(s)
 		mgr.addrToSessions[addr.String()] = s
 		mgr.roomToSessions[roomStr] = s
+		heap.Push(&mgr.expiry, s)
+		mgr.stats.RoomsCreated.Add(1)
+	}
+	mgr.replays.add(request.ID, request.Integrity, addr.String())
+	s.touch()
+	return s.Room, s.firstToken, msg.Err_OK
+}
+
+// newSessionToken VersionTwo的客户端不支持rebind，不分配token
+func newSessionToken(version uint32) string {
+	if version == msg.VersionTwo {
+		return ""
 	}
-	s.LastActiveTime = time.Now()
-	response := msg.NewCreateRoomResponse(request.ID, msg.Err_OK, s.Room)
-	logrus.Infof("Send CreateRoomResponse(%s) to %s", s.Room.String(), addr.String())
-	mgr.sendMessage(addr, response.ToBytes())
+	return randomID()
 }
 
-func (mgr *SessionManager) handleJoinRoomRequest(addr *net.UDPAddr, data []byte) {
+func (mgr *SessionManager) sendCreateRoomResponse(addr *net.UDPAddr, request *msg.CreateRoomRequest, key string, errCode int32, room uuid.UUID, token string, send SendFunc) {
+	response := msg.NewCreateRoomResponse(request.Version, request.ID, errCode, room, token)
+	send(addr, sign(request.Version, key, response.ToBytes()))
+}
+
+func (mgr *SessionManager) handleJoinRoomRequest(addr *net.UDPAddr, data []byte, send SendFunc) {
 	request := msg.ParseJoinRoomRequest(data)
 	if request == nil {
 		logrus.Debugf("ParseJoinRoomRequest failed")
+		mgr.stats.InvalidPackets.Add(1)
 		return
 	}
-	var s *Session
-	var exists bool
-	if s, exists = mgr.roomToSessions[request.Room.String()]; !exists {
-		logrus.Debugf("Received JoinRoomRequest with invalid room id:%s", request.Room)
+	if mgr.isBanned(addr, request.Username, "JoinRoomRequest") {
+		return
+	}
+	result := mgr.authenticator.AuthJoin(addr, request, data[:msg.BaseMessageSize-msg.IntegritySize])
+	errCode := result.ErrCode
+	if errCode == msg.Err_OK {
+		errCode = mgr.checkUserAddr(addr, request.Username)
+	}
+	if errCode != msg.Err_OK {
+		mgr.authFailed(addr, request.Username, errCode, result.CountUser)
+		mgr.sendJoinRoomResponse(addr, request, result.Key, errCode, "", send)
 		return
 	}
-	s2, exists := mgr.addrToSessions[addr.String()]
-	if exists {
-		if s2.SecondAddr == nil || s2.SecondAddr.String() != addr.String() {
-			logrus.Errorf("Received JoinRoomRequest(room:%s) from addrress(%s), but another addrress already join the session", request.Room, addr.String())
-			return
+	token, errCode := mgr.joinRoom(addr, request)
+	if errCode == msg.Err_OK {
+		logrus.Infof("Send JoinRoomResponse(%s) to %s", request.Room.String(), addr.String())
+	}
+	mgr.sendJoinRoomResponse(addr, request, result.Key, errCode, token, send)
+}
+
+// joinRoom 持锁完成验证之后的检查，并把地址加入session，返回加入方的session token
+func (mgr *SessionManager) joinRoom(addr *net.UDPAddr, request *msg.JoinRoomRequest) (string, int32) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if mgr.isBlocked(request.Username) {
+		logrus.Infof("Rejected JoinRoomRequest from blocked user %s", request.Username)
+		return "", msg.Err_AuthFailed
+	}
+	if mgr.isReplay(addr, request.ID, request.Integrity) {
+		logrus.Warnf("JoinRoomRequest(user:%s) from %s replayed", request.Username, addr.String())
+		mgr.authFailed(addr, request.Username, msg.Err_TimeInvalid, false)
+		return "", msg.Err_TimeInvalid
+	}
+	s, exists := mgr.roomToSessions[request.Room.String()]
+	if !exists {
+		logrus.Debugf("Received JoinRoomRequest with invalid room id:%s", request.Room)
+		return "", msg.Err_RoomInvalid
+	}
+	if s2, exists := mgr.addrToSessions[addr.String()]; exists {
+		if s2 != s || !sameAddr(s.SecondAddr, addr) {
+			logrus.Errorf("Received JoinRoomRequest(room:%s) from addrress(%s), but the address already belongs to room %s", request.Room, addr.String(), s2.Room)
+			return "", msg.Err_RoomInvalid
 		}
+	} else if s.SecondAddr != nil {
+		logrus.Errorf("Received JoinRoomRequest(room:%s) from addrress(%s), but another addrress already join the session", request.Room, addr.String())
+		return "", msg.Err_RoomInvalid
 	} else {
 		s.SecondAddr = addr
+		s.secondVersion = request.Version
+		s.secondUsername = request.Username
+		s.secondToken = newSessionToken(request.Version)
 		mgr.addrToSessions[addr.String()] = s
 	}
-	s.LastActiveTime = time.Now()
-	response := msg.NewJoinRoomResponse(request.ID, msg.Err_OK, request.Room)
-	logrus.Infof("Send JoinRoomResponse(%s) to %s", request.Room.String(), addr.String())
-	mgr.sendMessage(addr, response.ToBytes())
+	mgr.replays.add(request.ID, request.Integrity, addr.String())
+	s.touch()
+	return s.secondToken, msg.Err_OK
 }
 
-func (mgr *SessionManager) handleReflexRequest(addr *net.UDPAddr, data []byte) {
-	response := msg.NewReflexResponse(addr, mgr.authenticator.Token())
+func (mgr *SessionManager) sendJoinRoomResponse(addr *net.UDPAddr, request *msg.JoinRoomRequest, key string, errCode int32, token string, send SendFunc) {
+	response := msg.NewJoinRoomResponse(request.Version, request.ID, errCode, request.Room, token)
+	send(addr, sign(request.Version, key, response.ToBytes()))
+}
+
+// sign 用请求方的密钥给回复签名，让客户端可以校验回复确实来自relay。
+// key是验证请求时得到的密钥，验证没有通过时为空，回复不签名，客户端也不校验出错的回复；
+// VersionTwo的客户端不校验回复
+func sign(version uint32, key string, data []byte) []byte {
+	if version == msg.VersionTwo || data == nil || key == "" {
+		return data
+	}
+	msg.Sign(data, key)
+	return data
+}
+
+func (mgr *SessionManager) handleLeaveRoomRequest(addr *net.UDPAddr, data []byte, send SendFunc) {
+	request := msg.ParseLeaveRoomRequest(data)
+	if request == nil {
+		logrus.Debugf("ParseLeaveRoomRequest failed")
+		mgr.stats.InvalidPackets.Add(1)
+		return
+	}
+	if mgr.isBanned(addr, request.Username, "LeaveRoomRequest") {
+		return
+	}
+	result := mgr.authenticator.AuthLeave(addr, request, data[:msg.BaseMessageSize-msg.IntegritySize])
+	if result.ErrCode != msg.Err_OK {
+		mgr.authFailed(addr, request.Username, result.ErrCode, result.CountUser)
+		mgr.sendLeaveRoomResponse(addr, request.Version, result.Key, request.ID, result.ErrCode, request.Room, send)
+		return
+	}
+	peer, errCode := mgr.leaveRoom(addr, request)
+	mgr.sendLeaveRoomResponse(addr, request.Version, result.Key, request.ID, errCode, request.Room, send)
+	// VersionTwo的客户端不认识LeaveRoomResponse，会把它当成对端的数据
+	if peer != nil && peer.version != msg.VersionTwo {
+		logrus.Infof("Notify %s that room %s was closed by peer", peer.addr.String(), request.Room)
+		// 通知用对端的密钥签名
+		key, _ := mgr.authenticator.Key(peer.username)
+		mgr.sendLeaveRoomResponse(peer.addr, peer.version, key, msg.LeaveNotifyID, msg.Err_OK, request.Room, send)
+	}
+}
+
+// leavePeer 离开room时需要通知的另一方
+type leavePeer struct {
+	addr     *net.UDPAddr
+	version  uint32
+	username string
+}
+
+// leaveRoom 请求方必须是room的成员。返回还没离开的另一方，另一方还没加入时返回nil
+func (mgr *SessionManager) leaveRoom(addr *net.UDPAddr, request *msg.LeaveRoomRequest) (*leavePeer, int32) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if seen, from := mgr.replays.seen(request.ID, request.Integrity); seen {
+		if from == addr.String() {
+			// 回复丢失后客户端的重传，room已经在第一次请求时关闭
+			return nil, msg.Err_OK
+		}
+		logrus.Warnf("LeaveRoomRequest(user:%s) from %s replayed", request.Username, addr.String())
+		mgr.authFailed(addr, request.Username, msg.Err_TimeInvalid, false)
+		return nil, msg.Err_TimeInvalid
+	}
+	s, exists := mgr.roomToSessions[request.Room.String()]
+	if !exists {
+		logrus.Debugf("Received LeaveRoomRequest with invalid room id:%s", request.Room)
+		return nil, msg.Err_RoomInvalid
+	}
+	var peer *leavePeer
+	if sameAddr(addr, s.FirstAddr) {
+		if s.SecondAddr != nil {
+			peer = &leavePeer{addr: s.SecondAddr, version: s.secondVersion, username: s.secondUsername}
+		}
+	} else if sameAddr(addr, s.SecondAddr) {
+		peer = &leavePeer{addr: s.FirstAddr, version: s.firstVersion, username: s.Username}
+	} else {
+		logrus.Warnf("Received LeaveRoomRequest(room:%s) from %s, which is not a member of the room", request.Room, addr.String())
+		return nil, msg.Err_RoomInvalid
+	}
+	logrus.Infof("Room %s left by %s(%s)", s.Room, request.Username, addr.String())
+	mgr.replays.add(request.ID, request.Integrity, addr.String())
+	mgr.removeSession(s)
+	mgr.stats.RoomsLeft.Add(1)
+	return peer, msg.Err_OK
+}
+
+func (mgr *SessionManager) sendLeaveRoomResponse(addr *net.UDPAddr, version uint32, key string, ID string, errCode int32, room uuid.UUID, send SendFunc) {
+	response := msg.NewLeaveRoomResponse(version, ID, errCode, room)
+	send(addr, sign(version, key, response.ToBytes()))
+}
+
+// handleRebindRequest NAT映射变化后客户端从新地址发来的请求，验证通过后把session中
+// 这一方的地址换成新地址
+func (mgr *SessionManager) handleRebindRequest(addr *net.UDPAddr, data []byte, send SendFunc) {
+	request := msg.ParseRebindRequest(data)
+	if request == nil {
+		logrus.Debugf("ParseRebindRequest failed")
+		mgr.stats.InvalidPackets.Add(1)
+		return
+	}
+	if mgr.isBanned(addr, request.Username, "RebindRequest") {
+		return
+	}
+	result := mgr.authenticator.AuthRebind(addr, request, data[:msg.BaseMessageSize-msg.IntegritySize])
+	errCode := result.ErrCode
+	if errCode == msg.Err_OK {
+		errCode = mgr.checkUserAddr(addr, request.Username)
+	}
+	if errCode != msg.Err_OK {
+		mgr.authFailed(addr, request.Username, errCode, result.CountUser)
+		mgr.sendRebindResponse(addr, request, result.Key, errCode, send)
+		return
+	}
+	errCode = mgr.rebindRoom(addr, request)
+	mgr.sendRebindResponse(addr, request, result.Key, errCode, send)
+}
+
+// rebindRoom 在写锁内同时更新session和addrToSessions，worker不会看到只更新了一半的状态
+func (mgr *SessionManager) rebindRoom(addr *net.UDPAddr, request *msg.RebindRequest) int32 {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	if seen, from := mgr.replays.seen(request.ID, request.Integrity); seen {
+		if from == addr.String() {
+			// 回复丢失后客户端的重传，地址已经在第一次请求时更新
+			return msg.Err_OK
+		}
+		logrus.Warnf("RebindRequest(user:%s) from %s replayed", request.Username, addr.String())
+		mgr.authFailed(addr, request.Username, msg.Err_TimeInvalid, false)
+		return msg.Err_TimeInvalid
+	}
+	s, exists := mgr.roomToSessions[request.Room.String()]
+	if !exists {
+		logrus.Debugf("Received RebindRequest with invalid room id:%s", request.Room)
+		return msg.Err_RoomInvalid
+	}
+	var oldAddr **net.UDPAddr
+	var rtt *atomic.Int64
+	var username string
+	if s.firstToken != "" && sameToken(request.Token, s.firstToken) {
+		oldAddr, rtt, username = &s.FirstAddr, &s.firstRTT, s.Username
+	} else if s.secondToken != "" && sameToken(request.Token, s.secondToken) {
+		oldAddr, rtt, username = &s.SecondAddr, &s.secondRTT, s.secondUsername
+	} else {
+		logrus.Warnf("RebindRequest(room:%s) from %s session token invalid", request.Room, addr.String())
+		mgr.authFailed(addr, request.Username, msg.Err_AuthFailed, false)
+		return msg.Err_AuthFailed
+	}
+	if username != request.Username {
+		logrus.Warnf("RebindRequest(room:%s) from %s username %s mismatch", request.Room, addr.String(), request.Username)
+		mgr.authFailed(addr, request.Username, msg.Err_AuthFailed, false)
+		return msg.Err_AuthFailed
+	}
+	if sameAddr(*oldAddr, addr) {
+		s.touch()
+		mgr.replays.add(request.ID, request.Integrity, addr.String())
+		return msg.Err_OK
+	}
+	if s2, exists := mgr.addrToSessions[addr.String()]; exists {
+		logrus.Errorf("Received RebindRequest(room:%s) from addrress(%s), but the address already belongs to room %s", request.Room, addr.String(), s2.Room)
+		return msg.Err_AddressInvalid
+	}
+	logrus.Infof("Room %s: %s migrated from %s to %s", s.Room, username, (*oldAddr).String(), addr.String())
+	delete(mgr.addrToSessions, (*oldAddr).String())
+	mgr.addrToSessions[addr.String()] = s
+	*oldAddr = addr
+	// 新路径的RTT需要重新测量
+	rtt.Store(0)
+	s.touch()
+	mgr.replays.add(request.ID, request.Integrity, addr.String())
+	mgr.stats.Rebinds.Add(1)
+	return msg.Err_OK
+}
+
+// sameToken 按常量时间比较，不能通过回复的快慢逐字节猜出session token
+func sameToken(requestToken string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(requestToken), []byte(token)) == 1
+}
+
+func (mgr *SessionManager) sendRebindResponse(addr *net.UDPAddr, request *msg.RebindRequest, key string, errCode int32, send SendFunc) {
+	response := msg.NewRebindResponse(request.Version, request.ID, errCode, request.Room)
+	send(addr, sign(request.Version, key, response.ToBytes()))
+}
+
+func (mgr *SessionManager) handleReflexRequest(addr *net.UDPAddr, data []byte, send SendFunc) {
+	request := msg.ParseReflexRequest(data)
+	if request == nil {
+		logrus.Debugf("ParseReflexRequest failed")
+		mgr.stats.InvalidPackets.Add(1)
+		return
+	}
+	response := msg.NewReflexResponse(request.Version, addr, mgr.authenticator.Token(addr))
+	payload := response.ToBytes()
+	if payload == nil {
+		logrus.Warnf("Can't send ReflexResponse(version:%d) to %s", request.Version, addr.String())
+		return
+	}
 	logrus.Debugf("Send ReflexResponse to %s", addr.String())
-	mgr.sendMessage(addr, response.ToBytes())
+	send(addr, payload)
 }
 
-func (mgr *SessionManager) handleUnknownPacket(addr *net.UDPAddr, data []byte) {
+// handleKeepaliveRequest 客户端暂停发送数据时用来保持NAT映射和room，回复原样带回Time。
+// 不属于任何session的请求直接丢弃，避免relay被用来反射流量
+func (mgr *SessionManager) handleKeepaliveRequest(addr *net.UDPAddr, data []byte, send SendFunc) {
+	request := msg.ParseKeepaliveRequest(data)
+	if request == nil {
+		logrus.Debugf("ParseKeepaliveRequest failed")
+		mgr.stats.InvalidPackets.Add(1)
+		return
+	}
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	s, exists := mgr.addrToSessions[addr.String()]
+	if !exists || s.Room != request.Room {
+		mgr.stats.UnknownPackets.Add(1)
+		logrus.Debugf("Received KeepaliveRequest(room:%s) from %s without session", request.Room, addr.String())
+		return
+	}
+	s.touch()
+	response := msg.NewKeepaliveResponse(request.Version, request.ID, request.Room, request.Time)
+	send(addr, response.ToBytes())
+}
+
+// handleKeepaliveResponse 客户端对relay探测的回复，只用来计算RTT，不刷新活跃时间，
+// 否则只要客户端还在读数据，room就永远不会空闲超时
+func (mgr *SessionManager) handleKeepaliveResponse(addr *net.UDPAddr, data []byte) {
+	response := msg.ParseKeepaliveResponse(data)
+	if response == nil {
+		logrus.Debugf("ParseKeepaliveResponse failed")
+		mgr.stats.InvalidPackets.Add(1)
+		return
+	}
+	now := time.Now()
+	mgr.probeMutex.Lock()
+	probe, exists := mgr.probes[response.ID]
+	matched := exists && sameAddr(probe.addr, addr) && probe.room == response.Room
+	if matched {
+		delete(mgr.probes, response.ID)
+	}
+	mgr.probeMutex.Unlock()
+	if !matched {
+		// 过期、重复或伪造的回复
+		mgr.stats.UnknownPackets.Add(1)
+		logrus.Debugf("Received KeepaliveResponse(room:%s) from %s without pending probe", response.Room, addr.String())
+		return
+	}
+	rtt := now.Sub(probe.sentAt)
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	s, exists := mgr.addrToSessions[addr.String()]
+	if !exists || s.Room != response.Room {
+		mgr.stats.UnknownPackets.Add(1)
+		return
+	}
+	s.updateRTT(addr, rtt)
+}
+
+func (mgr *SessionManager) handleUnknownPacket(addr *net.UDPAddr, data []byte, send SendFunc) {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
 	if s, exists := mgr.addrToSessions[addr.String()]; exists {
-		s.LastActiveTime = time.Now()
-		s.RelayPacket(addr, data)
+		s.touch()
+		s.RelayPacket(addr, data, send)
+		if s.hasQueued() {
+			mgr.markQueued(s)
+		}
 	} else {
+		mgr.stats.UnknownPackets.Add(1)
 		logrus.Debugf("Received unknown packet from %s", addr.String())
 	}
 }
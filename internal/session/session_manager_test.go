@@ -0,0 +1,393 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"relay/internal/auth"
+	"relay/internal/conf"
+	"relay/internal/msg"
+
+	"github.com/google/uuid"
+)
+
+// discard 丢弃发出的包
+func discard(addr *net.UDPAddr, data []byte) {}
+
+func newTestManager() *SessionManager {
+	return &SessionManager{
+		addrToSessions: make(map[string]*Session),
+		roomToSessions: make(map[string]*Session),
+		userLimiters:   make(map[string]*userLimiter),
+		queuedSessions: make(map[*Session]struct{}),
+		blockedUsers:   make(map[string]time.Time),
+		probes:         make(map[string]pendingProbe),
+		bans:           newBanList(),
+		controlLimiter: newControlLimiter(),
+		access:         newAccessControl(),
+		replays:        newReplayCache(time.Minute, 0),
+		policy:         newLimitPolicy(),
+		timeouts:       newSessionTimeouts(),
+		stats:          newStats(),
+		authenticator:  auth.NewXmlAuthenticator(),
+	}
+}
+
+// joinRoomRequest 构造VersionTwo的JoinRoomRequest，字段偏移见msg.baseMessage。
+// 使用默认配置中的用户，密码为"password"加用户名的最后一位
+func joinRoomRequest(room uuid.UUID, username string) []byte {
+	return joinRoomRequestAt(room, username, time.Now())
+}
+
+func joinRoomRequestAt(room uuid.UUID, username string, at time.Time) []byte {
+	data := make([]byte, msg.BaseMessageSize)
+	binary.LittleEndian.PutUint32(data[0:], msg.MsgMagic)
+	binary.LittleEndian.PutUint32(data[4:], msg.VersionTwo)
+	binary.LittleEndian.PutUint32(data[8:], msg.TypeJoinRoomRequest)
+	binary.LittleEndian.PutUint64(data[16:], uint64(at.Unix()))
+	copy(data[48:64], "0123456789abcdef")
+	copy(data[64:80], username)
+	copy(data[80:96], room[:])
+	mac := hmac.New(sha1.New, []byte("password"+username[len(username)-1:]))
+	mac.Write(data[:msg.BaseMessageSize-msg.IntegritySize])
+	copy(data[msg.BaseMessageSize-msg.IntegritySize:], mac.Sum(nil))
+	return data
+}
+
+// newHalfOpenRoom user1创建的room，还没有人加入
+func newHalfOpenRoom(t *testing.T, mgr *SessionManager, port int) *Session {
+	t.Helper()
+	creator := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: port}
+	request := &msg.CreateRoomRequest{Version: msg.VersionTwo, ID: "0123456789abcdef", Username: "user1", Integrity: creator.String()}
+	room, _, errCode := mgr.createRoom(creator, request, auth.Limit{})
+	if errCode != msg.Err_OK {
+		t.Fatalf("createRoom = %d", errCode)
+	}
+	return mgr.roomToSessions[room.String()]
+}
+
+// newTestRoom user1创建room，user2加入
+func newTestRoom(t *testing.T, mgr *SessionManager, port int) *Session {
+	t.Helper()
+	s := newHalfOpenRoom(t, mgr, port)
+	joiner := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: port}
+	mgr.handleJoinRoomRequest(joiner, joinRoomRequest(s.Room, "user2"), discard)
+	if !sameAddr(s.SecondAddr, joiner) || s.secondUsername != "user2" {
+		t.Fatalf("join failed, SecondAddr = %v", s.SecondAddr)
+	}
+	return s
+}
+
+func TestCloseUserMatchesBothSides(t *testing.T) {
+	for _, username := range []string{"user1", "user2"} {
+		t.Run(username, func(t *testing.T) {
+			mgr := newTestManager()
+			newTestRoom(t, mgr, 1000)
+			newTestRoom(t, mgr, 2000)
+			if closed := mgr.CloseUser(username, time.Minute); closed != 2 {
+				t.Fatalf("CloseUser closed %d rooms, want 2", closed)
+			}
+			if len(mgr.roomToSessions) != 0 || len(mgr.addrToSessions) != 0 {
+				t.Fatalf("%d rooms and %d addresses left", len(mgr.roomToSessions), len(mgr.addrToSessions))
+			}
+			if !mgr.isBlocked(username) {
+				t.Fatal("user not blocked")
+			}
+		})
+	}
+}
+
+// captureErrCodes 记录回复给客户端的错误码
+func captureErrCodes() (SendFunc, *[]int32) {
+	var errCodes []int32
+	send := func(addr *net.UDPAddr, data []byte) {
+		errCodes = append(errCodes, int32(binary.LittleEndian.Uint32(data[12:])))
+	}
+	return send, &errCodes
+}
+
+func TestBlockedUserCannotJoin(t *testing.T) {
+	mgr := newTestManager()
+	send, errCodes := captureErrCodes()
+	s := newHalfOpenRoom(t, mgr, 1000)
+	mgr.CloseUser("user2", time.Minute)
+	joiner := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+	mgr.handleJoinRoomRequest(joiner, joinRoomRequest(s.Room, "user2"), send)
+	if s.SecondAddr != nil {
+		t.Fatal("blocked user joined the room")
+	}
+	if _, exists := mgr.addrToSessions[joiner.String()]; exists {
+		t.Fatal("blocked user's address registered")
+	}
+	mgr.handleJoinRoomRequest(joiner, joinRoomRequest(s.Room, "user1"), send)
+	if !sameAddr(s.SecondAddr, joiner) {
+		t.Fatal("user1 could not join after user2 was rejected")
+	}
+	if len(*errCodes) != 2 || (*errCodes)[0] != msg.Err_AuthFailed || (*errCodes)[1] != msg.Err_OK {
+		t.Fatalf("JoinRoomResponse error codes = %v", *errCodes)
+	}
+}
+
+func TestSignResponse(t *testing.T) {
+	room := uuid.New()
+	for _, version := range []uint32{msg.VersionTwo, msg.VersionThree} {
+		data := msg.NewJoinRoomResponse(version, "0123456789abcdef", msg.Err_OK, room, "").ToBytes()
+		signed := msg.Verify(sign(version, "password1", data), "password1")
+		// VersionTwo的客户端不校验回复
+		if signed != (version == msg.VersionThree) {
+			t.Errorf("version %d: signed = %v", version, signed)
+		}
+	}
+	data := msg.NewJoinRoomResponse(msg.VersionThree, "0123456789abcdef", msg.Err_AuthFailed, room, "").ToBytes()
+	// 验证没有通过时没有密钥，回复不签名
+	if msg.Verify(sign(msg.VersionThree, "", data), "") {
+		t.Error("response signed without a key")
+	}
+}
+
+// 重新加载后已有的room保持不变，新的限速立即生效
+func TestReloadKeepsRooms(t *testing.T) {
+	old := conf.Xml
+	t.Cleanup(func() { conf.Xml = old })
+	mgr := newTestManager()
+	s := newTestRoom(t, mgr, 1000)
+	r := &recorder{}
+	relayPackets(s, r, s.FirstAddr, 0, 60)
+	if len(r.sent) != 60 {
+		t.Fatalf("sent %d packets before reload, want 60", len(r.sent))
+	}
+
+	conf.Xml.RateLimit.SessionReqToResp = 8
+	conf.Xml.RateLimit.UserRespToReq = 8
+	mgr.Reload()
+	if mgr.roomToSessions[s.Room.String()] != s || mgr.addrToSessions[s.FirstAddr.String()] != s ||
+		mgr.addrToSessions[s.SecondAddr.String()] != s {
+		t.Fatal("room changed by reload")
+	}
+	if s.policy != mgr.policy {
+		t.Fatal("session still uses the old policy")
+	}
+	// 两个方向分别受session和用户级别的限速，容量都是最小的65536字节
+	r = &recorder{}
+	relayPackets(s, r, s.FirstAddr, 0, 60)
+	relayPackets(s, r, s.SecondAddr, 0, 60)
+	if len(r.sent) != 54+54 {
+		t.Fatalf("sent %d packets after reload, want 108", len(r.sent))
+	}
+	reqToResp, respToReq := s.Traffic()
+	if reqToResp.DroppedPackets != 6 || respToReq.DroppedPackets != 6 {
+		t.Fatalf("dropped %d and %d packets, want 6 and 6", reqToResp.DroppedPackets, respToReq.DroppedPackets)
+	}
+}
+
+func TestNewSessionToken(t *testing.T) {
+	if token := newSessionToken(msg.VersionTwo); token != "" {
+		t.Fatalf("VersionTwo token = %q, want empty", token)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token := newSessionToken(msg.VersionThree)
+		// 回复按C字符串解析Token，不能有0字节，也不能超过16字节
+		if len(token) != 16 || strings.IndexByte(token, 0) >= 0 {
+			t.Fatalf("token %q invalid", token)
+		}
+		if seen[token] {
+			t.Fatalf("token %q repeated", token)
+		}
+		seen[token] = true
+	}
+}
+
+// probeRoom 让双方都按VersionThree处理，发出一轮探测并返回收到的KeepaliveRequest
+func probeRoom(t *testing.T, mgr *SessionManager, s *Session) map[string]*msg.KeepaliveRequest {
+	t.Helper()
+	s.firstVersion, s.secondVersion = msg.VersionThree, msg.VersionThree
+	mgr.keepalive.Store(int64(time.Second))
+	r := &recorder{}
+	mgr.maybeProbeSessions(r.send)
+	requests := make(map[string]*msg.KeepaliveRequest)
+	for _, packet := range r.sent {
+		request := msg.ParseKeepaliveRequest(packet.data)
+		if request == nil || request.Room != s.Room {
+			t.Fatalf("probe sent to %v is not a KeepaliveRequest of the room", packet.addr)
+		}
+		requests[packet.addr.String()] = request
+	}
+	if len(requests) != 2 {
+		t.Fatalf("probed %d addresses, want 2", len(requests))
+	}
+	return requests
+}
+
+func keepaliveResponse(request *msg.KeepaliveRequest, t time.Time) []byte {
+	return msg.NewKeepaliveResponse(msg.VersionThree, request.ID, request.Room, t).ToBytes()
+}
+
+// RTT按relay记录的发送时间计算，与客户端带回的Time无关；回复不刷新room的活跃时间
+func TestKeepaliveRTT(t *testing.T) {
+	mgr := newTestManager()
+	s := newTestRoom(t, mgr, 1000)
+	lastActive := time.Now().Add(-20 * time.Second)
+	s.lastActive.Store(lastActive.UnixNano())
+	requests := probeRoom(t, mgr, s)
+
+	// 伪造的Time会让按客户端时间计算的RTT变成一个小时
+	mgr.handleKeepaliveResponse(s.FirstAddr, keepaliveResponse(requests[s.FirstAddr.String()], time.Now().Add(-time.Hour)))
+	info := s.info()
+	if info.FirstRTT <= 0 || info.FirstRTT > time.Second {
+		t.Fatalf("FirstRTT = %v", info.FirstRTT)
+	}
+	if info.SecondRTT != 0 {
+		t.Fatalf("SecondRTT = %v before the second side answered", info.SecondRTT)
+	}
+	if !s.LastActiveTime().Equal(time.Unix(0, lastActive.UnixNano())) {
+		t.Fatal("KeepaliveResponse refreshed the room's activity")
+	}
+
+	// 同一个回复再来一次，或者由另一方发来，都不再匹配
+	unknown := mgr.stats.UnknownPackets.Load()
+	mgr.handleKeepaliveResponse(s.FirstAddr, keepaliveResponse(requests[s.FirstAddr.String()], time.Now()))
+	mgr.handleKeepaliveResponse(s.FirstAddr, keepaliveResponse(requests[s.SecondAddr.String()], time.Now()))
+	if got := mgr.stats.UnknownPackets.Load() - unknown; got != 2 {
+		t.Fatalf("%d responses counted as unknown, want 2", got)
+	}
+	if s.info().SecondRTT != 0 {
+		t.Fatal("response from the wrong address updated SecondRTT")
+	}
+	mgr.handleKeepaliveResponse(s.SecondAddr, keepaliveResponse(requests[s.SecondAddr.String()], time.Now()))
+	if rtt := s.info().SecondRTT; rtt <= 0 || rtt > time.Second {
+		t.Fatalf("SecondRTT = %v", rtt)
+	}
+	if len(mgr.probes) != 0 {
+		t.Fatalf("%d probes still pending", len(mgr.probes))
+	}
+}
+
+// 客户端发起的keepalive刷新活跃时间，回复原样带回ID和Time
+func TestKeepaliveRequest(t *testing.T) {
+	mgr := newTestManager()
+	s := newTestRoom(t, mgr, 1000)
+	s.lastActive.Store(time.Now().Add(-20 * time.Second).UnixNano())
+	sent := time.UnixMilli(time.Now().Add(-time.Second).UnixMilli())
+	request := msg.NewKeepaliveRequest(msg.VersionThree, "", s.Room, sent).ToBytes()
+	r := &recorder{}
+	mgr.handleKeepaliveRequest(s.SecondAddr, request, r.send)
+	if len(r.sent) != 1 || !sameAddr(r.sent[0].addr, s.SecondAddr) {
+		t.Fatalf("sent %d responses", len(r.sent))
+	}
+	response := msg.ParseKeepaliveResponse(r.sent[0].data)
+	if response == nil || response.Room != s.Room || !response.Time.Equal(sent) {
+		t.Fatalf("response = %+v", response)
+	}
+	if time.Since(s.LastActiveTime()) > time.Second {
+		t.Fatal("KeepaliveRequest did not refresh the room's activity")
+	}
+	// 不属于任何room的地址不回复
+	stranger := &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: 9000}
+	mgr.handleKeepaliveRequest(stranger, request, r.send)
+	if len(r.sent) != 1 {
+		t.Fatal("replied to a keepalive from outside the room")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	mgr := newTestManager()
+	s := newTestRoom(t, mgr, 1000)
+	s.secondToken = newSessionToken(msg.VersionThree)
+	oldAddr := s.SecondAddr
+	newAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2001}
+	rebind := &msg.RebindRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: "user2",
+		Token: "wrong", Room: s.Room, Integrity: "r"}
+	if errCode := mgr.rebindRoom(newAddr, rebind); errCode != msg.Err_AuthFailed {
+		t.Fatalf("rebindRoom with wrong token = %d, want Err_AuthFailed", errCode)
+	}
+	rebind.Token = s.secondToken
+	for i := 0; i < 2; i++ {
+		if errCode := mgr.rebindRoom(newAddr, rebind); errCode != msg.Err_OK {
+			t.Fatalf("rebindRoom #%d = %d, want Err_OK", i, errCode)
+		}
+	}
+	if !sameAddr(s.SecondAddr, newAddr) || mgr.addrToSessions[newAddr.String()] != s {
+		t.Fatalf("SecondAddr = %v, want %v", s.SecondAddr, newAddr)
+	}
+	if _, exists := mgr.addrToSessions[oldAddr.String()]; exists {
+		t.Fatal("old address still mapped to the room")
+	}
+	if errCode := mgr.rebindRoom(oldAddr, rebind); errCode != msg.Err_TimeInvalid {
+		t.Fatalf("replayed rebindRoom = %d, want Err_TimeInvalid", errCode)
+	}
+	if rebinds := mgr.stats.Rebinds.Load(); rebinds != 1 {
+		t.Fatalf("Rebinds = %d, want 1", rebinds)
+	}
+}
+
+// token、地址和时间错误只计入来源IP，任何人都不能借此封禁别人的用户名；
+// 只有这些都正确而hmac错误时才计入用户名
+func TestAuthFailuresCountedAgainstUser(t *testing.T) {
+	mgr := newTestManager()
+	mgr.authenticator = auth.NewXmlAuthenticator()
+	mgr.bans = newTestBanList()
+	send := func(addr *net.UDPAddr, data []byte) {}
+	create := func(port int, password string, withToken bool, at time.Time) {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(port)), Port: port}
+		request := &msg.CreateRoomRequest{Version: msg.VersionThree, ID: "0123456789abcdef", Username: "user1",
+			Time: at, IP: addr.IP, Port: uint32(port)}
+		if withToken {
+			request.Token = mgr.authenticator.Token(addr)
+		}
+		data := request.ToBytes()
+		msg.Sign(data, password)
+		mgr.handleCreateRoomRequest(addr, data, send)
+	}
+	other := net.ParseIP("192.168.0.1")
+	for port := 1; port <= 3; port++ {
+		create(port, "wrong", false, time.Now())
+	}
+	for port := 4; port <= 6; port++ {
+		create(port, "wrong", true, time.Now().Add(-time.Hour))
+	}
+	if mgr.bans.isBanned(other, "user1", time.Now()) {
+		t.Fatal("username banned by token or time failures")
+	}
+	for port := 7; port <= 9; port++ {
+		create(port, "wrong", true, time.Now())
+	}
+	if !mgr.bans.isBanned(other, "user1", time.Now()) {
+		t.Fatal("username not banned after hmac failures")
+	}
+}
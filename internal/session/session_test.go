@@ -0,0 +1,213 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"net"
+	"testing"
+
+	"relay/internal/auth"
+	"relay/internal/conf"
+	"relay/internal/ratelimit"
+)
+
+var (
+	testFirstAddr  = &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	testSecondAddr = &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+)
+
+type sentPacket struct {
+	addr *net.UDPAddr
+	data []byte
+}
+
+// recorder 记录发出的包，send可以作为SendFunc使用
+type recorder struct {
+	sent []sentPacket
+}
+
+func (r *recorder) send(addr *net.UDPAddr, data []byte) {
+	r.sent = append(r.sent, sentPacket{addr, append([]byte(nil), data...)})
+}
+
+// newTestSession req_to_resp方向限速1000字节/秒，容量为最小的65536字节，
+// 测试过程中补充的令牌可以忽略。resp_to_req方向不限速
+func newTestSession(policy *limitPolicy) *Session {
+	return &Session{
+		FirstAddr:  testFirstAddr,
+		SecondAddr: testSecondAddr,
+		policy:     policy,
+		reqToResp:  relayDirection{bucket: ratelimit.NewBucket(1000, 0), total: &trafficCounter{}},
+		respToReq:  relayDirection{total: &trafficCounter{}},
+	}
+}
+
+// relayPackets 发送count个1200字节的包，第一个字节为序号
+func relayPackets(s *Session, r *recorder, from *net.UDPAddr, first int, count int) {
+	data := make([]byte, 1200)
+	for i := first; i < first+count; i++ {
+		data[0] = byte(i)
+		s.RelayPacket(from, data, r.send)
+	}
+}
+
+func TestRelayDropPolicy(t *testing.T) {
+	s, r := newTestSession(&limitPolicy{}), &recorder{}
+	// 65536字节的容量可以发送54个1200字节的包
+	relayPackets(s, r, testFirstAddr, 0, 60)
+	if len(r.sent) != 54 {
+		t.Fatalf("sent %d packets, want 54", len(r.sent))
+	}
+	for _, packet := range r.sent {
+		if !sameAddr(packet.addr, testSecondAddr) {
+			t.Fatalf("packet sent to %v", packet.addr)
+		}
+	}
+	if s.hasQueued() {
+		t.Fatal("drop policy queued packets")
+	}
+	relayPackets(s, r, testSecondAddr, 0, 60)
+	if len(r.sent) != 54+60 {
+		t.Fatalf("unlimited direction sent %d packets, want 60", len(r.sent)-54)
+	}
+	reqToResp, respToReq := s.Traffic()
+	want := TrafficStats{Packets: 54, Bytes: 54 * 1200, DroppedPackets: 6, DroppedBytes: 6 * 1200}
+	if reqToResp != want {
+		t.Fatalf("req_to_resp traffic = %+v, want %+v", reqToResp, want)
+	}
+	if respToReq != (TrafficStats{Packets: 60, Bytes: 60 * 1200}) {
+		t.Fatalf("resp_to_req traffic = %+v", respToReq)
+	}
+	if total := s.reqToResp.total.snapshot(); total != want {
+		t.Fatalf("total traffic = %+v, want %+v", total, want)
+	}
+}
+
+func TestRelayQueuePolicy(t *testing.T) {
+	s, r := newTestSession(&limitPolicy{queue: true, queueSize: 8}), &recorder{}
+	relayPackets(s, r, testFirstAddr, 0, 64)
+	if len(r.sent) != 54 || len(s.reqToResp.queue) != 8 {
+		t.Fatalf("sent %d packets and queued %d, want 54 and 8", len(r.sent), len(s.reqToResp.queue))
+	}
+	if reqToResp, _ := s.Traffic(); reqToResp.DroppedPackets != 2 || reqToResp.DroppedBytes != 2*1200 {
+		t.Fatalf("dropped %d packets and %d bytes, want 2 and %d", reqToResp.DroppedPackets, reqToResp.DroppedBytes, 2*1200)
+	}
+	// 模拟补充令牌后，新包也要排在队列后面，不能乱序
+	s.reqToResp.bucket.Refund(1 << 20)
+	s.flushDirection(&s.reqToResp, s.SecondAddr, r.send)
+	relayPackets(s, r, testFirstAddr, 64, 1)
+	if len(r.sent) != 54+8+1 || s.hasQueued() {
+		t.Fatalf("sent %d packets after refill, queued %v", len(r.sent), s.hasQueued())
+	}
+	// 队列满时丢弃的是62和63号包
+	for i, packet := range r.sent {
+		want := i
+		if i == 62 {
+			want = 64
+		}
+		if int(packet.data[0]) != want {
+			t.Fatalf("packet %d has sequence %d, want %d", i, packet.data[0], want)
+		}
+	}
+}
+
+func TestRelayUserBucket(t *testing.T) {
+	userBucket := ratelimit.NewBucket(1000, 0)
+	s1, r1 := newTestSession(&limitPolicy{}), &recorder{}
+	s2, r2 := newTestSession(&limitPolicy{}), &recorder{}
+	s1.reqToResp = relayDirection{userBucket: userBucket, total: &trafficCounter{}}
+	s2.reqToResp = relayDirection{bucket: ratelimit.NewBucket(1000, 0), userBucket: userBucket, total: &trafficCounter{}}
+	relayPackets(s1, r1, testFirstAddr, 0, 30)
+	relayPackets(s2, r2, testFirstAddr, 0, 30)
+	// 两个session共用65536字节
+	if len(r1.sent) != 30 || len(r2.sent) != 24 {
+		t.Fatalf("sent %d+%d packets, want 30+24", len(r1.sent), len(r2.sent))
+	}
+	// 用户级别的桶拒绝时归还session级别的令牌
+	userBucket.Refund(1 << 20)
+	if !s2.reqToResp.bucket.Allow(65536 - 24*1200) {
+		t.Fatal("session bucket not refunded")
+	}
+}
+
+func TestManagerFlushQueues(t *testing.T) {
+	mgr := newTestManager()
+	s, r := newTestSession(&limitPolicy{queue: true, queueSize: 8}), &recorder{}
+	mgr.addrToSessions[testFirstAddr.String()] = s
+	data := make([]byte, 1200)
+	for i := 0; i < 60; i++ {
+		mgr.handleUnknownPacket(testFirstAddr, data, r.send)
+	}
+	if _, exists := mgr.queuedSessions[s]; !exists {
+		t.Fatal("session with queued packets not tracked")
+	}
+	s.reqToResp.bucket.Refund(1 << 20)
+	mgr.flushQueues(r.send)
+	if len(r.sent) != 60 {
+		t.Fatalf("sent %d packets after flush, want 60", len(r.sent))
+	}
+	if len(mgr.queuedSessions) != 0 {
+		t.Fatal("flushed session still tracked")
+	}
+}
+
+func TestUserLimiter(t *testing.T) {
+	old := conf.Xml.Auth.Users
+	users := append(old[:0:0], old...)
+	users[0].ReqToResp = 8
+	conf.Xml.Auth.Users = users
+	t.Cleanup(func() { conf.Xml.Auth.Users = old })
+	mgr := &SessionManager{
+		userLimiters:  make(map[string]*userLimiter),
+		policy:        &limitPolicy{},
+		authenticator: auth.NewXmlAuthenticator(),
+	}
+	limiter := mgr.acquireUserLimiter(users[0].Username, mgr.authenticator.Limit(users[0].Username))
+	if mgr.acquireUserLimiter(users[0].Username, mgr.authenticator.Limit(users[0].Username)) != limiter {
+		t.Fatal("sessions of the same user got different limiters")
+	}
+	// 用户配置覆盖全局配置中的不限速
+	if limiter.reqToResp == nil || limiter.respToReq != nil {
+		t.Fatalf("limiter = %+v, want only req_to_resp limited", limiter)
+	}
+	other := mgr.acquireUserLimiter(users[1].Username, mgr.authenticator.Limit(users[1].Username))
+	if other.reqToResp != nil || other.respToReq != nil {
+		t.Fatalf("limiter of %s = %+v, want unlimited", users[1].Username, other)
+	}
+	mgr.releaseUserLimiter(users[0].Username)
+	if _, exists := mgr.userLimiters[users[0].Username]; !exists {
+		t.Fatal("limiter released while still referenced")
+	}
+	mgr.releaseUserLimiter(users[0].Username)
+	if _, exists := mgr.userLimiters[users[0].Username]; exists {
+		t.Fatal("limiter not released")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * BSD 3-Clause License
+ *
+ * Copyright (c) 2023 Zhennan Tu <zhennan.tu@gmail.com>
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright notice, this
+ *    list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ * 3. Neither the name of the copyright holder nor the names of its
+ *    contributors may be used to endorse or promote products derived from
+ *    this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package session
+
+import (
+	"relay/internal/msg"
+	"sync/atomic"
+	"time"
+)
+
+// DurationBuckets session时长直方图的上界(秒)
+var DurationBuckets = [...]float64{10, 60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// trafficCounter 单个转发方向的流量计数，Packets/Bytes只统计实际转发出去的
+type trafficCounter struct {
+	Packets        atomic.Uint64
+	Bytes          atomic.Uint64
+	DroppedPackets atomic.Uint64
+	DroppedBytes   atomic.Uint64
+}
+
+// TrafficStats trafficCounter的快照
+type TrafficStats struct {
+	Packets        uint64
+	Bytes          uint64
+	DroppedPackets uint64
+	DroppedBytes   uint64
+}
+
+// Stats 服务器全局计数。计数在收包goroutine中更新，可以在任意goroutine中读取
+type Stats struct {
+	ReqToResp       trafficCounter
+	RespToReq       trafficCounter
+	controlPackets  map[uint32]*atomic.Uint64 // 初始化后不再修改，并发读安全
+	UnknownPackets  atomic.Uint64             // 既不是控制消息，也不属于任何session
+	InvalidPackets  atomic.Uint64             // 控制消息解析失败
+	AuthFailures    atomic.Uint64
+	authFailures    map[int32]*atomic.Uint64 // 按错误码分类，初始化后不再修改
+	RoomsCreated    atomic.Uint64
+	RoomsRemoved    atomic.Uint64
+	RoomsExpired    atomic.Uint64 // 超时被清理的room，包含在RoomsRemoved中
+	RoomsClosed     atomic.Uint64 // 被管理员关闭的room，包含在RoomsRemoved中
+	RoomsLeft       atomic.Uint64 // 由成员主动离开而关闭的room，包含在RoomsRemoved中
+	Sweeps          atomic.Uint64 // 执行超时清理的次数
+	Rebinds         atomic.Uint64 // 通过RebindRequest更换地址的次数
+	Bans            atomic.Uint64 // 因验证失败过多封禁IP或用户名的次数
+	BannedRequests  atomic.Uint64 // 来自被封禁IP或用户名而被丢弃的请求
+	IPLimited       atomic.Uint64 // 超过单个IP的控制消息限速而被丢弃的包
+	GlobalLimited   atomic.Uint64 // 超过全局控制消息限速而被丢弃的包
+	DeniedPackets   atomic.Uint64 // 来源不在允许网段内而被丢弃的包
+	SessionDuration durationHistogram
+}
+
+// durationHistogram 已结束session的时长分布，桶为DurationBuckets
+type durationHistogram struct {
+	counts [len(DurationBuckets) + 1]atomic.Uint64 // 最后一个是+Inf
+	sum    atomic.Int64                            // 纳秒
+}
+
+// DurationHistogram durationHistogram的快照，Counts不是累积值
+type DurationHistogram struct {
+	Counts []uint64
+	Sum    time.Duration
+}
+
+// StatsSnapshot Stats的快照
+type StatsSnapshot struct {
+	ReqToResp          TrafficStats
+	RespToReq          TrafficStats
+	ControlPackets     map[uint32]uint64
+	UnknownPackets     uint64
+	InvalidPackets     uint64
+	AuthFailures       uint64
+	AuthFailuresByCode map[int32]uint64
+	RoomsCreated       uint64
+	RoomsRemoved       uint64
+	RoomsExpired       uint64
+	RoomsClosed        uint64
+	RoomsLeft          uint64
+	Sweeps             uint64
+	Rebinds            uint64
+	Bans               uint64
+	BannedRequests     uint64
+	IPLimited          uint64
+	GlobalLimited      uint64
+	DeniedPackets      uint64
+	SessionDuration    DurationHistogram
+}
+
+func newStats() *Stats {
+	stats := &Stats{
+		controlPackets: make(map[uint32]*atomic.Uint64),
+		authFailures:   make(map[int32]*atomic.Uint64),
+	}
+	for _, msgType := range []uint32{msg.TypeCreateRoomRequest, msg.TypeJoinRoomRequest, msg.TypeLeaveRoomRequest, msg.TypeRebindRequest, msg.TypeKeepaliveRequest, msg.TypeKeepaliveResponse, msg.TypeReflexRequest} {
+		stats.controlPackets[msgType] = &atomic.Uint64{}
+	}
+	for _, errCode := range []int32{msg.Err_AuthFailed, msg.Err_AddressInvalid, msg.Err_TimeInvalid, msg.Err_RoomInvalid, msg.Err_Unavailable} {
+		stats.authFailures[errCode] = &atomic.Uint64{}
+	}
+	return stats
+}
+
+func (st *Stats) addAuthFailure(errCode int32) {
+	st.AuthFailures.Add(1)
+	if counter, exists := st.authFailures[errCode]; exists {
+		counter.Add(1)
+	}
+}
+
+func (st *Stats) addControlPacket(msgType uint32) {
+	if counter, exists := st.controlPackets[msgType]; exists {
+		counter.Add(1)
+	}
+}
+
+func (st *Stats) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		ReqToResp:          st.ReqToResp.snapshot(),
+		RespToReq:          st.RespToReq.snapshot(),
+		ControlPackets:     make(map[uint32]uint64),
+		UnknownPackets:     st.UnknownPackets.Load(),
+		InvalidPackets:     st.InvalidPackets.Load(),
+		AuthFailures:       st.AuthFailures.Load(),
+		AuthFailuresByCode: make(map[int32]uint64),
+		RoomsCreated:       st.RoomsCreated.Load(),
+		RoomsRemoved:       st.RoomsRemoved.Load(),
+		RoomsExpired:       st.RoomsExpired.Load(),
+		RoomsClosed:        st.RoomsClosed.Load(),
+		RoomsLeft:          st.RoomsLeft.Load(),
+		Sweeps:             st.Sweeps.Load(),
+		Rebinds:            st.Rebinds.Load(),
+		Bans:               st.Bans.Load(),
+		BannedRequests:     st.BannedRequests.Load(),
+		IPLimited:          st.IPLimited.Load(),
+		GlobalLimited:      st.GlobalLimited.Load(),
+		DeniedPackets:      st.DeniedPackets.Load(),
+		SessionDuration:    st.SessionDuration.snapshot(),
+	}
+	for msgType, counter := range st.controlPackets {
+		snapshot.ControlPackets[msgType] = counter.Load()
+	}
+	for errCode, counter := range st.authFailures {
+		snapshot.AuthFailuresByCode[errCode] = counter.Load()
+	}
+	return snapshot
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(DurationBuckets) && seconds > DurationBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *durationHistogram) snapshot() DurationHistogram {
+	snapshot := DurationHistogram{
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		snapshot.Counts[i] = h.counts[i].Load()
+	}
+	return snapshot
+}
+
+func (c *trafficCounter) snapshot() TrafficStats {
+	return TrafficStats{
+		Packets:        c.Packets.Load(),
+		Bytes:          c.Bytes.Load(),
+		DroppedPackets: c.DroppedPackets.Load(),
+		DroppedBytes:   c.DroppedBytes.Load(),
+	}
+}
+
+func (c *trafficCounter) addRelayed(n int) {
+	c.Packets.Add(1)
+	c.Bytes.Add(uint64(n))
+}
+
+func (c *trafficCounter) addDropped(n int) {
+	c.DroppedPackets.Add(1)
+	c.DroppedBytes.Add(uint64(n))
+}